@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// apiKey is a client credential with its model access policy and rate limit. Patterns are globs where
+// "*" matches any run of characters (including "/") and "?" a single character.
+type apiKey struct {
+	Name        string   `json:"name"`
+	Key         string   `json:"key"`
+	AllowModels []string `json:"allow_models,omitempty"` // Empty allows every model not denied
+	DenyModels  []string `json:"deny_models,omitempty"`  // Takes precedence over AllowModels
+
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"` // Overrides RATE_LIMIT_PER_MINUTE
+
+	allowRe []*regexp.Regexp
+	denyRe  []*regexp.Regexp
+}
+
+// apiKeys holds the configured keys; a request is authorized if its Authorization header matches one.
+var apiKeys []*apiKey
+
+// initAPIKeys loads keys from API_KEYS_FILE (a JSON array of apiKey). Without it, the development
+// key is the only key, with its policy taken from MODEL_ALLOWLIST and MODEL_DENYLIST.
+func initAPIKeys() error {
+	var keys []*apiKey
+	if path := envString("API_KEYS_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys file: %w", err)
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return fmt.Errorf("failed to parse API keys file %s: %w", path, err)
+		}
+	} else {
+		keys = []*apiKey{{
+			Name:        "default",
+			Key:         authHeaderValue,
+			AllowModels: envList("MODEL_ALLOWLIST", nil),
+			DenyModels:  envList("MODEL_DENYLIST", nil),
+		}}
+	}
+
+	for i, key := range keys {
+		if key.Key == "" {
+			return fmt.Errorf("API key #%d (%s) has an empty key", i+1, key.Name)
+		}
+		if key.Name == "" {
+			key.Name = fmt.Sprintf("key_%d", i+1)
+		}
+		key.allowRe = compileModelGlobs(key.AllowModels)
+		key.denyRe = compileModelGlobs(key.DenyModels)
+	}
+	apiKeys = keys
+	slog.Info("Loaded API keys", "keys", len(keys))
+	return nil
+}
+
+// compileModelGlobs turns glob patterns into anchored regular expressions.
+func compileModelGlobs(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(strings.TrimSpace(pattern))
+		expr = strings.ReplaceAll(expr, `\*`, `.*`)
+		expr = strings.ReplaceAll(expr, `\?`, `.`)
+		compiled = append(compiled, regexp.MustCompile(`^`+expr+`$`))
+	}
+	return compiled
+}
+
+// lookupAPIKey returns the key matching the Authorization header value.
+func lookupAPIKey(token string) (*apiKey, bool) {
+	for _, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key.Key)) == 1 {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// authorize checks the request's Authorization header, writing a 403 if it matches no key.
+func authorize(w http.ResponseWriter, r *http.Request) (*apiKey, bool) {
+	key, ok := lookupAPIKey(r.Header.Get(authHeaderKey))
+	if !ok {
+		http.Error(w, "Forbidden: Invalid or missing authorization token", http.StatusForbidden)
+		return nil, false
+	}
+	auditEntry(w).APIKey = key.Name
+	return key, true
+}
+
+type apiKeyContextKey struct{}
+
+// requireAPIKey rejects requests without a valid API key and attaches the key to the context of
+// the others, for apiKeyFromContext.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := authorize(w, r)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// apiKeyFromContext returns the key that authorized the request, or nil on public routes.
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return key
+}
+
+// modelAllowed reports whether the key may use the model, requested directly or picked by auto routing.
+func (k *apiKey) modelAllowed(model string) bool {
+	for _, re := range k.denyRe {
+		if re.MatchString(model) {
+			return false
+		}
+	}
+	if len(k.allowRe) == 0 {
+		return true
+	}
+	for _, re := range k.allowRe {
+		if re.MatchString(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedModels lists the registry models the key may request.
+func (k *apiKey) allowedModels() []string {
+	var allowed []string
+	for _, m := range models.List() {
+		if k.modelAllowed(m.ID) {
+			allowed = append(allowed, m.ID)
+		}
+	}
+	return allowed
+}
+
+// canAutoRoute reports whether auto-routing has at least one model the key may use, among the
+// category routes and any experiment variant's routes.
+func (k *apiKey) canAutoRoute() bool {
+	for _, info := range classificationMap {
+		if k.modelAllowed(info.Model) {
+			return true
+		}
+		for _, candidate := range info.Candidates {
+			if k.modelAllowed(candidate) {
+				return true
+			}
+		}
+	}
+	for _, exp := range experiments {
+		for _, variant := range exp.Variants {
+			for _, route := range variant.Routes {
+				if k.modelAllowed(route.Model) {
+					return true
+				}
+				for _, candidate := range route.Candidates {
+					if k.modelAllowed(candidate) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// writeModelForbidden rejects a disallowed model with a 403 listing the permitted alternatives.
+// "auto" is only offered if auto-routing could pick a model the key may use.
+func writeModelForbidden(w http.ResponseWriter, key *apiKey, model string) {
+	allowed := key.allowedModels()
+	if key.canAutoRoute() {
+		allowed = append([]string{autoModelIdentifier}, allowed...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":          fmt.Sprintf("Forbidden: Model '%s' is not permitted for this API key", model),
+		"allowed_models": allowed,
+	})
+}
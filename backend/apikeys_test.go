@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	previous := apiKeys
+	apiKeys = []*apiKey{{Name: "web", Key: "web-key"}, {Name: "batch", Key: "batch-key"}}
+	t.Cleanup(func() { apiKeys = previous })
+
+	tests := []struct {
+		name     string
+		header   string
+		wantCode int
+		wantKey  string
+	}{
+		{"first key", "web-key", http.StatusOK, "web"},
+		{"second key", "batch-key", http.StatusOK, "batch"},
+		{"missing", "", http.StatusForbidden, ""},
+		{"wrong", "nope", http.StatusForbidden, ""},
+		{"prefix of a key", "web", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKey *apiKey
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotKey = apiKeyFromContext(r.Context())
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(authHeaderKey, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			requireAPIKey(next).ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			switch {
+			case tt.wantKey == "" && gotKey != nil:
+				t.Errorf("handler ran with key %s", gotKey.Name)
+			case tt.wantKey != "" && (gotKey == nil || gotKey.Name != tt.wantKey):
+				t.Errorf("handler got key %v, want %s", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestWriteModelForbiddenOffersAutoOnlyWhenRoutable(t *testing.T) {
+	withExperiments(t, `[{"name":"phi","variants":[{"name":"phi","weight":50,"routes":{"8":{"model":"microsoft/phi-4"}}}]}]`)
+	tests := []struct {
+		name     string
+		allow    []string
+		wantAuto bool
+	}{
+		{"a category model allowed", []string{"anthropic/claude-sonnet-4"}, true},
+		{"only a fallback candidate allowed", []string{"openai/gpt-4.1-nano"}, true},
+		{"only an experiment model allowed", []string{"microsoft/phi-4"}, true},
+		{"no routing target allowed", []string{"mistralai/*"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := &apiKey{Name: "restricted", allowRe: compileModelGlobs(tt.allow)}
+			rec := httptest.NewRecorder()
+			writeModelForbidden(rec, key, "openai/gpt-4o")
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			var body struct {
+				AllowedModels []string `json:"allowed_models"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.AllowedModels) == 0 {
+				t.Fatalf("no allowed models listed: %s", rec.Body)
+			}
+			if gotAuto := body.AllowedModels[0] == autoModelIdentifier; gotAuto != tt.wantAuto {
+				t.Errorf("allowed_models = %v, want auto offered: %v", body.AllowedModels, tt.wantAuto)
+			}
+		})
+	}
+}
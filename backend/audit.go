@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Audit log ---
+//
+// Every request to an instrumented route (except CORS preflights) appends one auditRecord to the
+// audit sink: who called (API key, or none for rejected calls), what was requested and served,
+// token counts and the status. With AUDIT_HASH_CONTENT the prompt and reply are stored as keyed
+// hashes (see contentHash), never as text; this needs LOG_CONTENT_HASH_KEY, so hashes stay
+// comparable across restarts. AUDIT_SINK selects the sink ("file", the default, or
+// "none"); the file sink appends to one JSONL file per UTC day in AUDIT_DIR. Records older than
+// AUDIT_RETENTION are purged hourly, and "backend audit-export" exports a time range.
+
+// auditRecord is one entry of the audit trail.
+type auditRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	RequestID        string    `json:"request_id,omitempty"`
+	APIKey           string    `json:"api_key,omitempty"` // Key name; empty if authorization failed
+	Method           string    `json:"method"`
+	Route            string    `json:"route"`
+	Status           int       `json:"status"`
+	DurationMS       int64     `json:"duration_ms"`
+	RequestedModel   string    `json:"requested_model,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	Category         string    `json:"category,omitempty"`
+	Stream           bool      `json:"stream,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	PromptHash       string    `json:"prompt_hash,omitempty"`
+	ResponseHash     string    `json:"response_hash,omitempty"`
+}
+
+// auditSink stores audit records. Append must be safe for concurrent use.
+type auditSink interface {
+	Append(record auditRecord) error
+	// Purge removes records older than before.
+	Purge(before time.Time) error
+	// Scan calls fn for each record with from <= Timestamp < to, oldest first.
+	Scan(from, to time.Time, fn func(auditRecord) error) error
+}
+
+// auditSinkFactories maps AUDIT_SINK values to sink constructors.
+var auditSinkFactories = map[string]func() (auditSink, error){
+	"file": func() (auditSink, error) { return newFileAuditSink(envString("AUDIT_DIR", "audit")) },
+}
+
+// auditConfig holds the audit settings.
+type auditConfig struct {
+	Retention   time.Duration // 0 keeps records forever
+	HashContent bool
+}
+
+var (
+	auditSettings = auditConfig{Retention: 90 * 24 * time.Hour}
+	activeAudit   auditSink
+)
+
+// initAudit opens the audit sink and starts the retention purge.
+func initAudit() error {
+	kind := strings.ToLower(envString("AUDIT_SINK", "file"))
+	if kind == "none" {
+		slog.Info("Audit log disabled")
+		return nil
+	}
+	auditSettings.Retention = envDuration("AUDIT_RETENTION", auditSettings.Retention)
+	auditSettings.HashContent = envBool("AUDIT_HASH_CONTENT", auditSettings.HashContent)
+	if auditSettings.HashContent && envString("LOG_CONTENT_HASH_KEY", "") == "" {
+		// The random per-process key would make hashes from different runs incomparable
+		return fmt.Errorf("AUDIT_HASH_CONTENT requires LOG_CONTENT_HASH_KEY")
+	}
+	sink, err := openAuditSink(kind)
+	if err != nil {
+		return err
+	}
+	activeAudit = sink
+	if auditSettings.Retention > 0 {
+		go runAuditPurge(sink, auditSettings.Retention)
+	}
+	slog.Info("Audit log enabled", "sink", kind, "retention", auditSettings.Retention.String(), "hash_content", auditSettings.HashContent)
+	return nil
+}
+
+func openAuditSink(kind string) (auditSink, error) {
+	factory, ok := auditSinkFactories[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown AUDIT_SINK %q", kind)
+	}
+	sink, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s audit sink: %w", kind, err)
+	}
+	return sink, nil
+}
+
+// runAuditPurge removes expired records now and then every hour.
+func runAuditPurge(sink auditSink, retention time.Duration) {
+	for {
+		if err := sink.Purge(time.Now().Add(-retention)); err != nil {
+			slog.Error("Failed to purge audit log", "error", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// auditEntry returns the audit record being built for the request, for handlers to fill in.
+// Writers not wrapped by instrumentHandler get a record that is discarded.
+func auditEntry(w http.ResponseWriter) *auditRecord {
+	if rec, ok := w.(*statusRecorder); ok {
+		return &rec.audit
+	}
+	return &auditRecord{}
+}
+
+// auditContent sets the hashes of the prompt and reply if content hashing is enabled.
+func (a *auditRecord) auditContent(prompt, response string) {
+	if !auditSettings.HashContent {
+		return
+	}
+	if prompt != "" {
+		a.PromptHash = contentHash(prompt)
+	}
+	if response != "" {
+		a.ResponseHash = contentHash(response)
+	}
+}
+
+// writeAudit completes a request's record and appends it to the sink.
+func writeAudit(rec *statusRecorder, r *http.Request, route string, started time.Time) {
+	if activeAudit == nil || r.Method == http.MethodOptions {
+		return
+	}
+	record := rec.audit
+	record.Timestamp = started.UTC()
+	record.Method, record.Route, record.Status = r.Method, route, rec.status
+	record.DurationMS = time.Since(started).Milliseconds()
+	if record.Model == "" {
+		record.Model = rec.model
+	}
+	if record.Category == "" {
+		record.Category = rec.category
+	}
+	if err := activeAudit.Append(record); err != nil {
+		metricAuditErrors.add(1)
+		logFor(r.Context()).Error("Failed to write audit record", "error", err)
+	}
+}
+
+// fileAuditSink appends records to one JSONL file per UTC day, named audit-YYYY-MM-DD.jsonl.
+type fileAuditSink struct {
+	dir  string
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+const auditDayLayout = "2006-01-02"
+
+func newFileAuditSink(dir string) (*fileAuditSink, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{dir: dir}, nil
+}
+
+func (s *fileAuditSink) Append(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	day := record.Timestamp.UTC().Format(auditDayLayout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil || s.day != day {
+		if s.file != nil {
+			s.file.Close()
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, "audit-"+day+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			s.file = nil
+			return err
+		}
+		s.file, s.day = f, day
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// days lists the days with an audit file, oldest first.
+func (s *fileAuditSink) days() ([]time.Time, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "audit-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "audit-"), ".jsonl")
+		if day, err := time.Parse(auditDayLayout, name); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+func (s *fileAuditSink) path(day time.Time) string {
+	return filepath.Join(s.dir, "audit-"+day.Format(auditDayLayout)+".jsonl")
+}
+
+// Purge deletes the files of days that ended before the cutoff.
+func (s *fileAuditSink) Purge(before time.Time) error {
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for _, day := range days {
+		if day.AddDate(0, 0, 1).After(before) {
+			break
+		}
+		if s.file != nil && s.day == day.Format(auditDayLayout) {
+			s.file.Close()
+			s.file = nil
+		}
+		if err := os.Remove(s.path(day)); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("Purged audit files", "files", removed, "before", before.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *fileAuditSink) Scan(from, to time.Time, fn func(auditRecord) error) error {
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if !day.AddDate(0, 0, 1).After(from) || !day.Before(to) {
+			continue
+		}
+		if err := scanAuditFile(s.path(day), from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanAuditFile(path string, from, to time.Time, fn func(auditRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, lineNo, err)
+		}
+		if record.Timestamp.Before(from) || !record.Timestamp.Before(to) {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// runAuditExportCommand implements the "audit-export" subcommand, writing the audit records of
+// a time range as JSONL, and returns the exit code. Dates are YYYY-MM-DD (UTC) or RFC 3339.
+//
+//	backend audit-export [-from 2026-01-01] [-to 2026-02-01] [-api-key name] [-out audit.jsonl]
+func runAuditExportCommand(args []string) int {
+	fs := flag.NewFlagSet("audit-export", flag.ContinueOnError)
+	fromFlag := fs.String("from", "", "Start of the range, inclusive (default: everything)")
+	toFlag := fs.String("to", "", "End of the range, exclusive (default: now)")
+	keyName := fs.String("api-key", "", "Only export calls made with this API key name")
+	outPath := fs.String("out", "", "Output path (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	from, to := time.Time{}, time.Now()
+	for _, bound := range []struct {
+		value string
+		t     *time.Time
+	}{{*fromFlag, &from}, {*toFlag, &to}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseAuditTime(bound.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit-export: %v\n", err)
+			return 2
+		}
+		*bound.t = t
+	}
+
+	sink, err := openAuditSink(strings.ToLower(envString("AUDIT_SINK", "file")))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit-export: %v\n", err)
+		return 1
+	}
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit-export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	exported := 0
+	err = sink.Scan(from, to, func(record auditRecord) error {
+		if *keyName != "" && record.APIKey != *keyName {
+			return nil
+		}
+		exported++
+		return enc.Encode(record)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit-export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d audit records.\n", exported)
+	return 0
+}
+
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(auditDayLayout, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestInitAuditHashContentNeedsKey(t *testing.T) {
+	previous, previousSink := auditSettings, activeAudit
+	t.Cleanup(func() { auditSettings, activeAudit = previous, previousSink })
+	tests := []struct {
+		name    string
+		hash    string
+		key     string
+		wantErr bool
+	}{
+		{"hashing without a key", "true", "", true},
+		{"hashing with a key", "true", "secret", false},
+		{"no hashing", "false", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUDIT_SINK", "file")
+			t.Setenv("AUDIT_DIR", t.TempDir())
+			t.Setenv("AUDIT_RETENTION", "0")
+			t.Setenv("AUDIT_HASH_CONTENT", tt.hash)
+			t.Setenv("LOG_CONTENT_HASH_KEY", tt.key)
+			auditSettings = previous
+			if err := initAudit(); (err != nil) != tt.wantErr {
+				t.Errorf("initAudit() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
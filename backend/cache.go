@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// classificationCache is an LRU cache with per-entry TTL mapping a normalized
+// classification input to the category returned by the classifier.
+type classificationCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // Front = most recently used
+	entries  map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type classificationCacheEntry struct {
+	key      string
+	category string
+	expires  time.Time
+}
+
+// classificationCacheStats is the JSON view of the cache counters.
+type classificationCacheStats struct {
+	Enabled  bool    `json:"enabled"`
+	Size     int     `json:"size"`
+	Capacity int     `json:"capacity"`
+	TTL      string  `json:"ttl"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// classifierCache is the process-wide cache in front of classifyPrompt; nil when disabled.
+var classifierCache *classificationCache
+
+// newClassificationCache creates a cache holding at most capacity entries for ttl each.
+func newClassificationCache(capacity int, ttl time.Duration) *classificationCache {
+	return &classificationCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// initClassificationCache configures the cache from CLASSIFICATION_CACHE_SIZE (0 disables it)
+// and CLASSIFICATION_CACHE_TTL.
+func initClassificationCache() {
+	size := envInt("CLASSIFICATION_CACHE_SIZE", 1024)
+	ttl := envDuration("CLASSIFICATION_CACHE_TTL", time.Hour)
+	if size <= 0 || ttl <= 0 {
+		slog.Info("Classification cache disabled")
+		return
+	}
+	classifierCache = newClassificationCache(size, ttl)
+	slog.Info("Classification cache enabled", "size", size, "ttl", ttl.String())
+}
+
+// classificationCacheKey normalizes the classification input (case, whitespace, trailing
+// punctuation) so near-identical prompts share an entry, and hashes it together with the
+// classifier model so switching models never serves stale categories.
+func classificationCacheKey(userInput string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(userInput), " "))
+	normalized = strings.TrimRight(normalized, " .!?")
+	sum := sha256.Sum256([]byte(classificationModel + "\x00" + normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached category for key, counting a hit or a miss.
+func (c *classificationCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	entry := elem.Value.(*classificationCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		c.misses++
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	c.hits++
+	return entry.category, true
+}
+
+// Put stores the category for key, evicting the least recently used entry when full.
+func (c *classificationCache) Put(key, category string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*classificationCacheEntry)
+		entry.category = category
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&classificationCacheEntry{key: key, category: category, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*classificationCacheEntry).key)
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *classificationCache) Stats() classificationCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := classificationCacheStats{
+		Enabled:  true,
+		Size:     c.order.Len(),
+		Capacity: c.capacity,
+		TTL:      c.ttl.String(),
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// classifyPromptCached consults the classification cache before calling classifyPrompt.
+// Only results that map to a known category are cached. The second return value reports a cache hit.
+func classifyPromptCached(ctx context.Context, userInput string) (string, bool, error) {
+	if classifierCache == nil {
+		category, err := classifyPrompt(ctx, userInput)
+		return category, false, err
+	}
+
+	key := classificationCacheKey(userInput)
+	if category, ok := classifierCache.Get(key); ok {
+		return category, true, nil
+	}
+	category, err := classifyPrompt(ctx, userInput)
+	if err != nil {
+		return "", false, err
+	}
+	if _, ok := classificationMap[category]; ok {
+		classifierCache.Put(key, category)
+	}
+	return category, false, nil
+}
+
+// classificationCacheHandler reports the classification cache hit/miss counters as JSON.
+func classificationCacheHandler(w http.ResponseWriter, r *http.Request) {
+	stats := classificationCacheStats{}
+	if classifierCache != nil {
+		stats = classifierCache.Stats()
+	}
+	jsonResponse(w, stats)
+}
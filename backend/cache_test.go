@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassificationCacheEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		ops         []string // "put:<key>" or "get:<key>"
+		wantPresent []string
+		wantEvicted []string
+	}{
+		{"oldest evicted", []string{"put:a", "put:b", "put:c"}, []string{"b", "c"}, []string{"a"}},
+		{"get refreshes recency", []string{"put:a", "put:b", "get:a", "put:c"}, []string{"a", "c"}, []string{"b"}},
+		{"put refreshes recency", []string{"put:a", "put:b", "put:a", "put:c"}, []string{"a", "c"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClassificationCache(2, time.Hour)
+			for _, op := range tt.ops {
+				switch key := op[4:]; op[:4] {
+				case "put:":
+					c.Put(key, "1")
+				case "get:":
+					c.Get(key)
+				}
+			}
+			for _, key := range tt.wantPresent {
+				if _, ok := c.Get(key); !ok {
+					t.Errorf("%s was evicted", key)
+				}
+			}
+			for _, key := range tt.wantEvicted {
+				if _, ok := c.Get(key); ok {
+					t.Errorf("%s is still cached", key)
+				}
+			}
+			if size := c.Stats().Size; size > 2 {
+				t.Errorf("size = %d, over capacity 2", size)
+			}
+		})
+	}
+}
+
+func TestClassificationCacheExpiry(t *testing.T) {
+	c := newClassificationCache(10, 20*time.Millisecond)
+	c.Put("a", "1")
+	if category, ok := c.Get("a"); !ok || category != "1" {
+		t.Fatalf("Get before expiry = %q, %v", category, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entry still served")
+	}
+	if size := c.Stats().Size; size != 0 {
+		t.Errorf("size = %d after expiry, want the entry removed", size)
+	}
+
+	// Putting again renews the TTL
+	c.Put("b", "1")
+	time.Sleep(15 * time.Millisecond)
+	c.Put("b", "2")
+	time.Sleep(15 * time.Millisecond)
+	if category, ok := c.Get("b"); !ok || category != "2" {
+		t.Errorf("renewed entry = %q, %v, want 2", category, ok)
+	}
+}
+
+func TestClassificationCacheKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"What is Go?", "what is go", true},
+		{"  what   is\n go ", "what is go", true},
+		{"what is go!!!", "What is go?", true},
+		{"what is go", "what is rust", false},
+		{"is it go?", "is it, go", false},
+	}
+	for _, tt := range tests {
+		if same := classificationCacheKey(tt.a) == classificationCacheKey(tt.b); same != tt.same {
+			t.Errorf("key(%q) == key(%q) is %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+
+	previous := classificationModel
+	t.Cleanup(func() { classificationModel = previous })
+	key := classificationCacheKey("what is go")
+	classificationModel = "another-model"
+	if classificationCacheKey("what is go") == key {
+		t.Error("key doesn't change with the classifier model")
+	}
+}
+
+func TestClassificationCacheStats(t *testing.T) {
+	c := newClassificationCache(10, time.Hour)
+	if stats := c.Stats(); stats.Hits != 0 || stats.Misses != 0 || stats.HitRatio != 0 {
+		t.Errorf("empty cache stats = %+v", stats)
+	}
+	c.Get("a") // Miss
+	c.Put("a", "1")
+	c.Get("a") // Hit
+	c.Get("a") // Hit
+	c.Get("b") // Miss
+	stats := c.Stats()
+	if !stats.Enabled || stats.Size != 1 || stats.Capacity != 10 || stats.Hits != 2 || stats.Misses != 2 || stats.HitRatio != 0.5 {
+		t.Errorf("stats = %+v, want 2 hits, 2 misses, ratio 0.5", stats)
+	}
+}
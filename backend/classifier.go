@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Classification sources reported in the metadata event.
+const (
+	classificationSourceRule      = "rule"
+	classificationSourceCache     = "cache"
+	classificationSourceModel     = "model"
+	classificationSourceHeuristic = "fallback_heuristic"
+	classificationSourceRemote    = "fallback_model"
+	classificationSourceDefault   = "fallback_default"
+)
+
+// Fallback strategies accepted in CLASSIFIER_FALLBACK, tried in the configured order.
+const (
+	fallbackHeuristic = "heuristic" // Rule layer without the confidence threshold
+	fallbackModel     = "model"     // Secondary classifier model via OpenRouter
+	fallbackDefault   = "default"   // Fixed category
+)
+
+var (
+	errInvalidClassification = errors.New("invalid classification result")
+	errOllamaUnavailable     = errors.New("Ollama classifier is marked unavailable")
+)
+
+// classificationOutcome describes how the category for an auto request was chosen.
+type classificationOutcome struct {
+	Category       string
+	Source         string
+	Rule           string  // Set when Source is rule or fallback_heuristic
+	Confidence     float64 // Rule confidence, if any
+	FallbackReason string  // Why the primary classifier was bypassed, if it was
+}
+
+// classifierFallbackConfig holds the degradation settings for when Ollama is unavailable.
+type classifierFallbackConfig struct {
+	Strategies      []string
+	Model           string // OpenRouter model for the "model" strategy
+	DefaultCategory string
+	ProbeInterval   time.Duration
+}
+
+var classifierFallback = classifierFallbackConfig{
+	Strategies:      []string{fallbackHeuristic, fallbackDefault},
+	Model:           "google/gemini-2.0-flash-001",
+	DefaultCategory: "1",
+	ProbeInterval:   30 * time.Second,
+}
+
+// ollamaHealthState tracks the last known availability of the Ollama classifier.
+type ollamaHealthState struct {
+	mu        sync.RWMutex
+	healthy   bool
+	lastErr   error
+	checkedAt time.Time
+}
+
+var ollamaHealth = &ollamaHealthState{healthy: true}
+
+// set records a probe or request outcome and logs availability transitions.
+func (s *ollamaHealthState) set(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	healthy := err == nil
+	if healthy != s.healthy {
+		if healthy {
+			slog.Info("Ollama classifier is available again")
+		} else {
+			slog.Warn("Ollama classifier marked unavailable", "error", err)
+		}
+	}
+	s.healthy = healthy
+	s.lastErr = err
+	s.checkedAt = time.Now()
+}
+
+// status returns the last known availability, error and check time.
+func (s *ollamaHealthState) status() (bool, error, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.healthy, s.lastErr, s.checkedAt
+}
+
+// initClassifierFallback reads the fallback configuration, checks Ollama once and starts the
+// background probe. CLASSIFIER_FALLBACK is a comma-separated list of heuristic, model and default
+// (empty or "none" disables fallback); CLASSIFIER_FALLBACK_MODEL, CLASSIFIER_DEFAULT_CATEGORY and
+// CLASSIFIER_PROBE_INTERVAL (0 disables probing) tune the individual strategies.
+func initClassifierFallback() error {
+	cfg := classifierFallback
+	if raw, ok := os.LookupEnv("CLASSIFIER_FALLBACK"); ok {
+		cfg.Strategies = nil
+		for _, strategy := range strings.Split(raw, ",") {
+			strategy = strings.ToLower(strings.TrimSpace(strategy))
+			switch strategy {
+			case "", "none":
+			case fallbackHeuristic, fallbackModel, fallbackDefault:
+				cfg.Strategies = append(cfg.Strategies, strategy)
+			default:
+				return fmt.Errorf("unknown classifier fallback strategy %q", strategy)
+			}
+		}
+	}
+	cfg.Model = envString("CLASSIFIER_FALLBACK_MODEL", cfg.Model)
+	cfg.DefaultCategory = envString("CLASSIFIER_DEFAULT_CATEGORY", cfg.DefaultCategory)
+	if _, ok := classificationMap[cfg.DefaultCategory]; !ok {
+		return fmt.Errorf("CLASSIFIER_DEFAULT_CATEGORY %q is not a known category", cfg.DefaultCategory)
+	}
+	cfg.ProbeInterval = envDuration("CLASSIFIER_PROBE_INTERVAL", cfg.ProbeInterval)
+	classifierFallback = cfg
+	slog.Info("Classifier fallback configured", "strategies", cfg.Strategies)
+
+	// Startup health check; failing it is not fatal, the fallback chain covers it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := probeOllama(ctx)
+	cancel()
+	ollamaHealth.set(err) // Logs the failure, if any
+	if err == nil {
+		slog.Info("Ollama classifier is available", "model", classificationModel, "url", ollamaBaseURL())
+	}
+
+	if cfg.ProbeInterval > 0 {
+		go runOllamaProbe(context.Background(), cfg.ProbeInterval)
+	}
+	return nil
+}
+
+// ollamaBaseURL derives the Ollama server root from ollamaURL.
+func ollamaBaseURL() string {
+	return strings.TrimSuffix(strings.TrimSuffix(ollamaURL, "/"), "/api/generate")
+}
+
+// probeOllama checks that Ollama responds and has the classification model available.
+func probeOllama(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ollamaBaseURL()+"/api/tags", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Ollama tags endpoint returned status %d", resp.StatusCode)
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return fmt.Errorf("failed to decode Ollama tags response: %w", err)
+	}
+	for _, m := range tags.Models {
+		if m.Name == classificationModel || m.Name == classificationModel+":latest" {
+			return nil
+		}
+	}
+	return fmt.Errorf("classification model %s is not available in Ollama", classificationModel)
+}
+
+// runOllamaProbe periodically refreshes ollamaHealth so a rebooted Ollama host is picked up again,
+// until ctx is done.
+func runOllamaProbe(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		ollamaHealth.set(probeOllama(probeCtx))
+		cancel()
+	}
+}
+
+// ollamaAvailable reports whether the primary classifier should be tried. Without a
+// background probe there is nothing to bring it back, so it is always tried.
+func ollamaAvailable() bool {
+	if classifierFallback.ProbeInterval <= 0 {
+		return true
+	}
+	healthy, _, _ := ollamaHealth.status()
+	return healthy
+}
+
+// classifyRequest picks the category for an auto request: deterministic rules first, then the
+// (cached) Ollama classifier, then the configured fallback strategies if Ollama failed.
+func classifyRequest(ctx context.Context, userInput string) (classificationOutcome, error) {
+	if match, ok := matchClassificationRule(userInput); ok {
+		return classificationOutcome{
+			Category:   match.Category,
+			Source:     classificationSourceRule,
+			Rule:       match.Rule,
+			Confidence: match.Confidence,
+		}, nil
+	}
+
+	primaryErr := errOllamaUnavailable
+	if ollamaAvailable() {
+		category, cacheHit, err := classifyPromptCached(ctx, userInput)
+		if err == nil {
+			if _, ok := classificationMap[category]; ok {
+				source := classificationSourceModel
+				if cacheHit {
+					source = classificationSourceCache
+				}
+				return classificationOutcome{Category: category, Source: source}, nil
+			}
+			err = fmt.Errorf("%w from %s", errInvalidClassification, classificationModel)
+		} else {
+			// The request itself failed, so Ollama is likely down until the probe says otherwise.
+			ollamaHealth.set(err)
+		}
+		primaryErr = err
+	}
+	return classifyWithFallback(ctx, userInput, primaryErr)
+}
+
+// classifyWithFallback runs the configured fallback strategies in order. If none produces a
+// category, primaryErr is returned.
+func classifyWithFallback(ctx context.Context, userInput string, primaryErr error) (classificationOutcome, error) {
+	reason := primaryErr.Error()
+	logger := logFor(ctx).With("reason", reason)
+	for _, strategy := range classifierFallback.Strategies {
+		switch strategy {
+		case fallbackHeuristic:
+			if match, ok := matchClassificationRuleAbove(userInput, 0); ok {
+				logger.Warn("Classifier fallback: heuristic rule chose category", "rule", match.Rule, "category", match.Category)
+				return classificationOutcome{
+					Category:       match.Category,
+					Source:         classificationSourceHeuristic,
+					Rule:           match.Rule,
+					Confidence:     match.Confidence,
+					FallbackReason: reason,
+				}, nil
+			}
+		case fallbackModel:
+			category, err := classifyWithOpenRouter(ctx, userInput, classifierFallback.Model)
+			if err != nil {
+				logger.Warn("Classifier fallback model failed", "model", classifierFallback.Model, "error", err)
+				continue
+			}
+			logger.Warn("Classifier fallback: model chose category", "model", classifierFallback.Model, "category", category)
+			return classificationOutcome{Category: category, Source: classificationSourceRemote, FallbackReason: reason}, nil
+		case fallbackDefault:
+			logger.Warn("Classifier fallback: using default category", "category", classifierFallback.DefaultCategory)
+			return classificationOutcome{
+				Category:       classifierFallback.DefaultCategory,
+				Source:         classificationSourceDefault,
+				FallbackReason: reason,
+			}, nil
+		}
+	}
+	return classificationOutcome{}, primaryErr
+}
+
+var classificationNumberRe = regexp.MustCompile(`\b(10|[1-9])\b`)
+
+// classifyWithOpenRouter asks a (remote) OpenRouter model for the category, using the same
+// prompt as the Ollama classifier.
+func classifyWithOpenRouter(ctx context.Context, userInput, modelName string) (string, error) {
+	messages := []chatMessage{{Role: "user", Content: buildClassificationPrompt(userInput)}}
+	response, err := getOpenRouterResponse(ctx, messages, modelName)
+	if err != nil {
+		return "", err
+	}
+	category := classificationNumberRe.FindString(response)
+	if _, ok := classificationMap[category]; !ok {
+		logFor(ctx).Warn("Classifier fallback model returned an unexpected classification", "model", modelName, contentAttr("response", response))
+		return "", fmt.Errorf("%w from %s", errInvalidClassification, modelName)
+	}
+	return category, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubOllamaServer answers /api/tags with the classification model while up is set (503
+// otherwise) and /api/generate with category, counting the generate calls.
+type stubOllamaServer struct {
+	*httptest.Server
+	up        atomic.Bool
+	generated atomic.Int32
+}
+
+func newStubOllamaServer(t *testing.T, category string) *stubOllamaServer {
+	t.Helper()
+	stub := &stubOllamaServer{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !stub.up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/tags":
+			json.NewEncoder(w).Encode(map[string]interface{}{"models": []map[string]string{{"name": classificationModel}}})
+		case "/api/generate":
+			stub.generated.Add(1)
+			json.NewEncoder(w).Encode(ollamaResponse{Response: category, Done: true})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// withClassifier points the classifier at ollama with the given fallback settings and the rule
+// set, restoring the globals afterwards.
+func withClassifier(t *testing.T, ollama *stubOllamaServer, fallback classifierFallbackConfig, rules []classificationRule) {
+	t.Helper()
+	compiled, err := compileClassificationRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousURL, previousFallback, previousHealth := ollamaURL, classifierFallback, ollamaHealth
+	previousCache, previousRules := classifierCache, classificationRules
+	t.Cleanup(func() {
+		ollamaURL, classifierFallback, ollamaHealth = previousURL, previousFallback, previousHealth
+		classifierCache, classificationRules = previousCache, previousRules
+	})
+	ollamaURL = ollama.URL + "/api/generate"
+	classifierFallback = fallback
+	ollamaHealth = &ollamaHealthState{healthy: true}
+	classifierCache = nil
+	classificationRules = compiled
+}
+
+func TestClassifierFallbackModes(t *testing.T) {
+	// Below the confidence threshold, so only the heuristic fallback uses it
+	lowConfidence := []classificationRule{{Name: "forecast", Category: "2", Keywords: []string{"forecast"}, Confidence: 0.5}}
+	tests := []struct {
+		name        string
+		strategies  []string
+		prompt      string
+		remoteReply string
+		wantSource  string
+		wantCat     string
+	}{
+		{"heuristic", []string{fallbackHeuristic}, "forecast for Zagreb", "", classificationSourceHeuristic, "2"},
+		{"heuristic without a match", []string{fallbackHeuristic}, "tell me a story", "", "", ""},
+		{"secondary model", []string{fallbackModel}, "tell me a story", "9", classificationSourceRemote, "9"},
+		{"secondary model invalid, then default", []string{fallbackModel, fallbackDefault}, "tell me a story", "banana", classificationSourceDefault, "4"},
+		{"default category", []string{fallbackDefault}, "tell me a story", "", classificationSourceDefault, "4"},
+		{"order is kept", []string{fallbackDefault, fallbackHeuristic}, "forecast for Zagreb", "", classificationSourceDefault, "4"},
+		{"no fallback", nil, "tell me a story", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRouter(t)
+			ollama := newStubOllamaServer(t, "3") // Down
+			withClassifier(t, ollama, classifierFallbackConfig{
+				Strategies: tt.strategies, Model: "google/gemini-2.0-flash-001", DefaultCategory: "4",
+			}, lowConfidence)
+			remote := newStubOpenRouter(t, tt.remoteReply)
+
+			outcome, err := classifyRequest(context.Background(), tt.prompt)
+			if tt.wantSource == "" {
+				if err == nil {
+					t.Fatalf("classified as %+v, want the Ollama error", outcome)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome.Source != tt.wantSource || outcome.Category != tt.wantCat || outcome.FallbackReason == "" {
+				t.Errorf("outcome = %+v, want %s from %s with a fallback reason", outcome, tt.wantCat, tt.wantSource)
+			}
+			if usedRemote := len(remote.received()) > 0; usedRemote != (tt.remoteReply != "") {
+				t.Errorf("secondary model called = %v", usedRemote)
+			}
+			if healthy, _, _ := ollamaHealth.status(); healthy {
+				t.Error("failed Ollama request didn't mark Ollama unavailable")
+			}
+		})
+	}
+}
+
+func TestOllamaProbeRestoresClassifier(t *testing.T) {
+	ollama := newStubOllamaServer(t, "3")
+	withClassifier(t, ollama, classifierFallbackConfig{
+		Strategies: []string{fallbackDefault}, DefaultCategory: "4", ProbeInterval: 10 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runOllamaProbe(ctx, classifierFallback.ProbeInterval)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor := func(available bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for ollamaAvailable() != available {
+			if time.Now().After(deadline) {
+				t.Fatalf("probe didn't mark Ollama available = %v", available)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(false)
+	outcome, err := classifyRequest(context.Background(), "tell me a story")
+	if err != nil || outcome.Source != classificationSourceDefault || outcome.FallbackReason != errOllamaUnavailable.Error() {
+		t.Fatalf("while down: %+v, %v, want the default fallback", outcome, err)
+	}
+	if n := ollama.generated.Load(); n != 0 {
+		t.Errorf("Ollama asked to classify %d times while marked unavailable", n)
+	}
+
+	ollama.up.Store(true)
+	waitFor(true)
+	outcome, err = classifyRequest(context.Background(), "tell me a story")
+	if err != nil || outcome.Source != classificationSourceModel || outcome.Category != "3" {
+		t.Errorf("after recovery: %+v, %v, want 3 from the model", outcome, err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Multi-model compare ---
+//
+// POST /api/compare sends one messages payload to several models at once and streams their
+// outputs as interleaved SSE events. Each model is streamed by streamOpenRouterResponse into a
+// modelStreamWriter, which re-emits OpenRouter's chunks as "chunk" events tagged with the model.
+//
+//	event: metadata     {"request_id": ..., "models": [...]}
+//	event: chunk        {"model": ..., "chunk": <OpenRouter chunk>}
+//	event: error        {"model": ..., "error": ...}
+//	event: model_done   compareResult
+//	event: summary      {"results": [compareResult, ...]}
+//	data: [DONE]
+
+// compareRequest is the body of POST /api/compare.
+type compareRequest struct {
+	Models   []string      `json:"models"`
+	Messages []chatMessage `json:"messages"`
+	providerOptions
+}
+
+// compareResult is a model's latency, token usage and cost.
+type compareResult struct {
+	Model             string             `json:"model"`
+	Error             string             `json:"error,omitempty"`
+	TimeToFirstToken  int64              `json:"time_to_first_token_ms,omitempty"`
+	LatencyMS         int64              `json:"latency_ms"`
+	PromptTokens      int                `json:"prompt_tokens"`
+	CompletionTokens  int                `json:"completion_tokens"`
+	TokenSource       string             `json:"token_source"` // "provider" or the local token count method
+	CostUSD           *float64           `json:"cost_usd,omitempty"`
+	ContextManagement *contextTrimReport `json:"context_management,omitempty"`
+}
+
+var compareMaxModels = 4
+
+// initCompare reads the comparison settings.
+func initCompare() error {
+	compareMaxModels = envInt("COMPARE_MAX_MODELS", 4)
+	if compareMaxModels < 2 {
+		return fmt.Errorf("COMPARE_MAX_MODELS must be at least 2, got %d", compareMaxModels)
+	}
+	slog.Info("Model comparison configured", "max_models", compareMaxModels)
+	return nil
+}
+
+// compareStream serializes events from concurrent model streams onto one response.
+type compareStream struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+func (s *compareStream) send(event string, data interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeSSE(s.w, ServerSentEvent{Event: event, Data: string(mustJSON(data))}); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// modelStreamWriter is the http.ResponseWriter given to streamOpenRouterResponse for one model.
+// It parses the forwarded SSE lines and sends each chunk as a tagged event on the shared stream.
+type modelStreamWriter struct {
+	stream     *compareStream
+	model      string
+	header     http.Header
+	pending    []byte
+	started    time.Time
+	firstToken time.Duration
+	usage      *streamUsage
+}
+
+// streamUsage is the usage block OpenRouter sends with the last chunk when the request has
+// "usage": {"include": true}.
+type streamUsage struct {
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Cost             *float64 `json:"cost,omitempty"`
+}
+
+func (m *modelStreamWriter) Header() http.Header { return m.header }
+
+func (m *modelStreamWriter) WriteHeader(int) {}
+
+func (m *modelStreamWriter) Flush() {}
+
+func (m *modelStreamWriter) Write(p []byte) (int, error) {
+	m.pending = append(m.pending, p...)
+	for {
+		i := bytes.IndexByte(m.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimSpace(string(m.pending[:i]))
+		m.pending = m.pending[i+1:]
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue // Blank separators, comments and the end marker
+		}
+		var chunk struct {
+			StreamChunk
+			Usage *streamUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err == nil {
+			if chunk.Usage != nil {
+				m.usage = chunk.Usage
+			}
+			if m.firstToken == 0 && len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+				m.firstToken = time.Since(m.started)
+			}
+		}
+		if err := m.stream.send("chunk", map[string]interface{}{"model": m.model, "chunk": json.RawMessage(data)}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// compareHandler serves POST /api/compare.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, key := requestIDFromContext(ctx), apiKeyFromContext(ctx)
+	logger := logFor(ctx)
+
+	var req compareRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, "Bad Request: 'messages' field cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Models) < 2 || len(req.Models) > compareMaxModels {
+		http.Error(w, fmt.Sprintf("Bad Request: 'models' must list 2 to %d models", compareMaxModels), http.StatusBadRequest)
+		return
+	}
+
+	// Validate every model and fit the messages to each one's context before streaming anything
+	results := make([]compareResult, len(req.Models))
+	messages := make([][]chatMessage, len(req.Models))
+	seen := make(map[string]bool)
+	for i, model := range req.Models {
+		if seen[model] || strings.ToLower(model) == autoModelIdentifier {
+			http.Error(w, "Bad Request: 'models' must be distinct and cannot include 'auto'", http.StatusBadRequest)
+			return
+		}
+		seen[model] = true
+		if err := models.Validate(model); err != nil {
+			http.Error(w, "Bad Request: Unknown model '"+model+"'. See GET /api/models for available models.", http.StatusBadRequest)
+			return
+		}
+		if !key.modelAllowed(model) {
+			writeModelForbidden(w, key, model)
+			return
+		}
+		trimmed, report, err := fitMessagesToContext(ctx, req.Messages, model)
+		if err != nil {
+			logger.Error("Context window exceeded for compare model", "model", model, "error", err)
+			http.Error(w, "Bad Request: Conversation exceeds the context window of "+model, http.StatusBadRequest)
+			return
+		}
+		messages[i] = trimmed
+		results[i] = compareResult{Model: model}
+		if len(report.StrategiesApplied) > 0 {
+			results[i].ContextManagement = &report
+		}
+	}
+
+	logger.Info("Comparing models", "models", req.Models)
+	audit := auditEntry(w)
+	audit.RequestedModel, audit.Stream = strings.Join(req.Models, ","), true
+	setupSSEHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	stream := &compareStream{w: w}
+	if err := stream.send("metadata", map[string]interface{}{"request_id": requestID, "models": req.Models}); err != nil {
+		logger.Error("Failed to write compare metadata event", "error", err)
+		return
+	}
+
+	// Ask for the provider's token counts and cost, which otherwise aren't sent on streams
+	opts := req.providerOptions
+	opts.Usage = json.RawMessage(`{"include":true}`)
+	var wg sync.WaitGroup
+	for i := range req.Models {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := &results[i]
+			mw := &modelStreamWriter{stream: stream, model: result.Model, header: make(http.Header), started: time.Now()}
+			content, _, err := streamOpenRouterResponse(ctx, mw, messages[i], result.Model, opts)
+			result.LatencyMS = time.Since(mw.started).Milliseconds()
+			result.TimeToFirstToken = mw.firstToken.Milliseconds()
+			if err != nil {
+				logger.Error("Compare stream failed", "model", result.Model, "error", err)
+				result.Error = err.Error()
+				stream.send("error", map[string]string{"model": result.Model, "error": err.Error()})
+			}
+			result.fillUsage(mw.usage, messages[i], content)
+			stream.send("model_done", result)
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		audit.PromptTokens += result.PromptTokens
+		audit.CompletionTokens += result.CompletionTokens
+	}
+
+	stream.send("summary", map[string]interface{}{"results": results})
+	stream.mu.Lock()
+	sendDoneSSE(ctx, w)
+	stream.mu.Unlock()
+	logger.Info("Finished compare request")
+}
+
+// fillUsage sets token counts and cost from OpenRouter's usage block, or estimates them.
+func (c *compareResult) fillUsage(usage *streamUsage, messages []chatMessage, content string) {
+	defer func() { recordTokenUsage(c.Model, c.PromptTokens, c.CompletionTokens) }()
+	if usage != nil {
+		c.PromptTokens, c.CompletionTokens, c.TokenSource = usage.PromptTokens, usage.CompletionTokens, "provider"
+		if usage.Cost != nil {
+			c.CostUSD = usage.Cost
+			return
+		}
+	} else {
+		c.PromptTokens, c.TokenSource = countMessagesTokens(c.Model, messages)
+		c.CompletionTokens, _ = countTextTokens(c.Model, content)
+	}
+	if cost, ok := estimateCostUSD(c.Model, c.PromptTokens, c.CompletionTokens); ok {
+		c.CostUSD = &cost
+	}
+}
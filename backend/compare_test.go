@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompareUsesProviderUsage(t *testing.T) {
+	handler := setupTestRouter(t)
+	stub := newStubOpenRouter(t, "Two models answer.")
+	rec := postJSON(handler, "/api/compare", `{"models":["openai/gpt-4o-mini","x-ai/grok-3-mini-beta"],"messages":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, req := range stub.received() {
+		if !strings.Contains(string(req.Usage), `"include":true`) {
+			t.Errorf("request for %s has usage %s, want include", req.Model, req.Usage)
+		}
+	}
+	var summary struct {
+		Results []compareResult `json:"results"`
+	}
+	body := rec.Body.String()
+	i := strings.Index(body, "event: summary\ndata: ")
+	if i < 0 {
+		t.Fatalf("no summary event in %s", body)
+	}
+	line := strings.SplitN(body[i+len("event: summary\ndata: "):], "\n", 2)[0]
+	if err := json.Unmarshal([]byte(line), &summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range summary.Results {
+		if result.TokenSource != "provider" || result.PromptTokens != 12 || result.CompletionTokens != 3 || result.CostUSD == nil {
+			t.Errorf("result %+v, want the provider's usage", result)
+		}
+	}
+}
+
+func TestInitCompare(t *testing.T) {
+	previous := compareMaxModels
+	t.Cleanup(func() { compareMaxModels = previous })
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 4, false},
+		{"2", 2, false},
+		{"6", 6, false},
+		{"1", 0, true},
+		{"0", 0, true},
+		{"-3", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run("COMPARE_MAX_MODELS="+tt.value, func(t *testing.T) {
+			t.Setenv("COMPARE_MAX_MODELS", tt.value)
+			err := initCompare()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && compareMaxModels != tt.want {
+				t.Errorf("compareMaxModels = %d, want %d", compareMaxModels, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Environment-based configuration helpers ---
+//
+// All runtime configuration is read from environment variables, in the same
+// way OPENROUTER_API_KEY is. Invalid values are logged and the default is used.
+
+// envString returns the value of the environment variable or def if it is unset or empty.
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable or def.
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("Invalid integer, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envFloat returns the float value of the environment variable or def.
+func envFloat(key string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("Invalid number, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// envBool returns the boolean value of the environment variable or def.
+func envBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("Invalid boolean, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return b
+}
+
+// envDuration returns the duration value (e.g. "30s", "5m") of the environment variable or def.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("Invalid duration, using default", "key", key, "value", v, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// envList returns the comma-separated values of the environment variable, or def if unset.
+func envList(key string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
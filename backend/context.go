@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Context management strategies accepted in CONTEXT_STRATEGIES, applied in order until the
+// messages fit the model's budget. The system prompt is pinned unless CONTEXT_PIN_SYSTEM=false,
+// and the last user message (and anything after it) is never removed.
+const (
+	contextStrategySummarize  = "summarize"   // Replace older turns with a summary from a cheap model
+	contextStrategyDropOldest = "drop_oldest" // Drop the oldest turns
+)
+
+// contextConfig holds the context management settings.
+type contextConfig struct {
+	Strategies         []string
+	PinSystem          bool
+	ReserveTokens      int // Kept free for the model's reply
+	SummaryModel       string
+	SummaryKeepRecent  int // Most recent trimmable messages never summarized
+	DefaultBudgetChars int
+}
+
+var contextSettings = contextConfig{
+	Strategies:         []string{contextStrategyDropOldest},
+	PinSystem:          true,
+	ReserveTokens:      4096,
+	SummaryModel:       "google/gemini-2.0-flash-001",
+	SummaryKeepRecent:  4,
+	DefaultBudgetChars: ContextMaxChars,
+}
+
+// contextTrimReport describes what context management did, for the metadata event.
+type contextTrimReport struct {
+	BudgetTokens       int      `json:"budget_tokens"`
+	TokensBefore       int      `json:"estimated_tokens_before"`
+	TokensAfter        int      `json:"estimated_tokens_after"`
+	CountMethod        string   `json:"token_count_method"` // Tokenizer encoding or "heuristic"
+	DroppedMessages    int      `json:"dropped_messages,omitempty"`
+	SummarizedMessages int      `json:"summarized_messages,omitempty"`
+	StrategiesApplied  []string `json:"strategies_applied,omitempty"`
+}
+
+// contextEntry is a message, its token count and whether context management may remove it.
+type contextEntry struct {
+	msg    chatMessage
+	tokens int
+	pinned bool
+}
+
+// initContextManagement reads CONTEXT_STRATEGIES, CONTEXT_PIN_SYSTEM, CONTEXT_RESERVE_TOKENS,
+// CONTEXT_SUMMARY_MODEL and CONTEXT_SUMMARY_KEEP_RECENT.
+func initContextManagement() error {
+	cfg := contextSettings
+	cfg.Strategies = nil
+	for _, strategy := range envList("CONTEXT_STRATEGIES", contextSettings.Strategies) {
+		switch strategy = strings.ToLower(strategy); strategy {
+		case contextStrategySummarize, contextStrategyDropOldest:
+			cfg.Strategies = append(cfg.Strategies, strategy)
+		case "none":
+		default:
+			return fmt.Errorf("unknown context strategy %q", strategy)
+		}
+	}
+	cfg.PinSystem = envBool("CONTEXT_PIN_SYSTEM", cfg.PinSystem)
+	cfg.ReserveTokens = envInt("CONTEXT_RESERVE_TOKENS", cfg.ReserveTokens)
+	cfg.SummaryModel = envString("CONTEXT_SUMMARY_MODEL", cfg.SummaryModel)
+	cfg.SummaryKeepRecent = envInt("CONTEXT_SUMMARY_KEEP_RECENT", cfg.SummaryKeepRecent)
+	contextSettings = cfg
+	slog.Info("Context management configured", "strategies", cfg.Strategies, "pin_system", cfg.PinSystem)
+	return nil
+}
+
+// contextBudgetTokens returns how many prompt tokens may be sent to the model. The window comes
+// from the model registry; unknown models get a budget derived from ContextMaxChars.
+func contextBudgetTokens(model string) int {
+	info, ok := models.Lookup(model)
+	if !ok || info.ContextLength <= 0 {
+		return contextSettings.DefaultBudgetChars / 3
+	}
+	window := info.ContextLength
+	budget := window - contextSettings.ReserveTokens
+	if budget < window/2 {
+		budget = window / 2
+	}
+	return budget
+}
+
+// fitMessagesToContext applies the configured strategies until messages fit the model's budget.
+// It returns an error if the pinned messages and the latest turn alone exceed the budget.
+func fitMessagesToContext(ctx context.Context, messages []chatMessage, model string) ([]chatMessage, contextTrimReport, error) {
+	report := contextTrimReport{BudgetTokens: contextBudgetTokens(model)}
+	report.TokensBefore, report.CountMethod = countMessagesTokens(model, messages)
+	report.TokensAfter = report.TokensBefore
+	if report.TokensBefore <= report.BudgetTokens {
+		return messages, report, nil
+	}
+
+	// Everything from the last user message on is the current turn and always kept.
+	lastUser := len(messages) - 1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			lastUser = i
+			break
+		}
+	}
+	entries := make([]contextEntry, len(messages))
+	for i, msg := range messages {
+		entries[i] = contextEntry{msg: msg, tokens: countMessageTokens(model, msg), pinned: i >= lastUser || (contextSettings.PinSystem && msg.Role == "system")}
+	}
+
+	for _, strategy := range contextSettings.Strategies {
+		if entriesTokens(entries) <= report.BudgetTokens {
+			break
+		}
+		switch strategy {
+		case contextStrategySummarize:
+			var summarized int
+			entries, summarized = summarizeOldestEntries(ctx, entries, model)
+			if summarized > 0 {
+				report.SummarizedMessages += summarized
+				report.StrategiesApplied = append(report.StrategiesApplied, strategy)
+			}
+		case contextStrategyDropOldest:
+			var dropped int
+			entries, dropped = dropOldestEntries(entries, report.BudgetTokens)
+			if dropped > 0 {
+				report.DroppedMessages += dropped
+				report.StrategiesApplied = append(report.StrategiesApplied, strategy)
+			}
+		}
+	}
+
+	trimmed := make([]chatMessage, len(entries))
+	for i, e := range entries {
+		trimmed[i] = e.msg
+	}
+	report.TokensAfter = entriesTokens(entries)
+	if report.TokensAfter > report.BudgetTokens {
+		return nil, report, fmt.Errorf("messages need about %d tokens but %s allows %d", report.TokensAfter, model, report.BudgetTokens)
+	}
+	logFor(ctx).Info("Context trimmed", "model", model, "tokens_before", report.TokensBefore, "tokens_after", report.TokensAfter,
+		"dropped_messages", report.DroppedMessages, "summarized_messages", report.SummarizedMessages)
+	return trimmed, report, nil
+}
+
+func entriesTokens(entries []contextEntry) int {
+	total := 0
+	for _, e := range entries {
+		total += e.tokens
+	}
+	return total
+}
+
+// dropOldestEntries removes unpinned entries oldest-first until the budget is met. Assistant
+// replies left at the start of the history without their user message are dropped along with it,
+// and tool calls are dropped together with their results.
+func dropOldestEntries(entries []contextEntry, budget int) ([]contextEntry, int) {
+	dropped, total := 0, entriesTokens(entries)
+	for total > budget {
+		idx := -1
+		for i, e := range entries {
+			if !e.pinned {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			break // Only pinned messages left
+		}
+		end := entryUnitEnd(entries, idx)
+		for end < len(entries) && !entries[end].pinned && entries[end].msg.Role == "assistant" {
+			end = entryUnitEnd(entries, end)
+		}
+		for _, e := range entries[idx:end] {
+			total -= e.tokens
+		}
+		dropped += end - idx
+		entries = append(entries[:idx], entries[end:]...)
+	}
+	return entries, dropped
+}
+
+// entryUnitEnd returns the end of the unit starting at entries[i]: an assistant message with tool
+// calls and the tool results that follow it, which providers reject when separated, or else just
+// the one entry.
+func entryUnitEnd(entries []contextEntry, i int) int {
+	end := i + 1
+	if entries[i].msg.Role == "assistant" && len(entries[i].msg.ToolCalls) > 0 {
+		for end < len(entries) && !entries[end].pinned && entries[end].msg.Role == "tool" {
+			end++
+		}
+	}
+	return end
+}
+
+// summarizeOldestEntries replaces all but the most recent SummaryKeepRecent unpinned entries with
+// a single system message summarizing them. If they don't all fit the summary model, the oldest
+// are left out of the summary. On failure the entries are returned unchanged.
+func summarizeOldestEntries(ctx context.Context, entries []contextEntry, model string) ([]contextEntry, int) {
+	var unpinned []int
+	for i, e := range entries {
+		if !e.pinned {
+			unpinned = append(unpinned, i)
+		}
+	}
+	count := len(unpinned) - contextSettings.SummaryKeepRecent
+	for count > 0 && count < len(unpinned) && entries[unpinned[count]].msg.Role == "tool" {
+		count++ // Summarize tool results with the call they answer
+	}
+	if count < 2 {
+		return entries, 0 // Not worth a summary call
+	}
+	toSummarize := unpinned[:count]
+
+	instructions := "Summarize the following earlier part of a conversation between a user and an assistant. " +
+		"Keep facts, decisions, names, numbers and open questions needed to continue the conversation. " +
+		"Reply with the summary only.\n\n"
+	transcript, omitted := summaryTranscript(entries, toSummarize, instructions)
+	if transcript == "" {
+		logFor(ctx).Warn("Messages too long to summarize", "messages", count, "model", contextSettings.SummaryModel)
+		return entries, 0
+	}
+	if omitted > 0 {
+		logFor(ctx).Info("Summarizing only the most recent messages that fit the summary model", "messages", count, "omitted", omitted)
+	}
+	summary, err := getOpenRouterResponse(ctx, []chatMessage{{Role: "user", Content: instructions + transcript}}, contextSettings.SummaryModel)
+	if err != nil {
+		logFor(ctx).Warn("Failed to summarize messages", "messages", count, "model", contextSettings.SummaryModel, "error", err)
+		return entries, 0
+	}
+
+	summaryMsg := chatMessage{Role: "system", Content: "Summary of the earlier conversation:\n" + strings.TrimSpace(summary)}
+	summaryEntry := contextEntry{msg: summaryMsg, tokens: countMessageTokens(model, summaryMsg)}
+	result := make([]contextEntry, 0, len(entries)-count+1)
+	first := toSummarize[0]
+	skip := make(map[int]bool, count)
+	for _, i := range toSummarize {
+		skip[i] = true
+	}
+	for i, e := range entries {
+		if i == first {
+			result = append(result, summaryEntry)
+		}
+		if !skip[i] {
+			result = append(result, e)
+		}
+	}
+	return result, count
+}
+
+// summaryTranscript renders the entries to summarize as "role: content" lines, newest first until
+// the summary model's budget is used up, and returns the transcript in order along with how many
+// older entries were left out. It returns "" if not even the newest entry fits.
+func summaryTranscript(entries []contextEntry, indexes []int, instructions string) (string, int) {
+	model := contextSettings.SummaryModel
+	used, _ := countTextTokens(model, instructions)
+	used += messageOverheadTokens
+	budget := contextBudgetTokens(model)
+
+	var lines []string
+	omitted := 0
+	for k := len(indexes) - 1; k >= 0; k-- {
+		msg := entries[indexes[k]].msg
+		line := fmt.Sprintf("%s: %s\n\n", msg.Role, msg.Content)
+		n, _ := countTextTokens(model, line)
+		if used+n > budget {
+			omitted = k + 1
+			break
+		}
+		used += n
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", omitted
+	}
+	var transcript strings.Builder
+	if omitted > 0 {
+		fmt.Fprintf(&transcript, "[%d earlier messages omitted]\n\n", omitted)
+	}
+	for k := len(lines) - 1; k >= 0; k-- {
+		transcript.WriteString(lines[k])
+	}
+	return transcript.String(), omitted
+}
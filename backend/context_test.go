@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// withContextSettings runs a test with the given budget (in heuristic tokens) for unknown models.
+func withContextSettings(t *testing.T, budgetTokens int, strategies ...string) {
+	t.Helper()
+	previous := contextSettings
+	t.Cleanup(func() { contextSettings = previous })
+	contextSettings.DefaultBudgetChars = budgetTokens * 3
+	contextSettings.Strategies = strategies
+}
+
+// turn returns a message of about 100 heuristic tokens.
+func turn(role, label string) chatMessage {
+	return chatMessage{Role: role, Content: label + " " + strings.Repeat("x", 300-len(label)-1)}
+}
+
+func TestDropOldest(t *testing.T) {
+	withContextSettings(t, 350, contextStrategyDropOldest)
+	messages := []chatMessage{
+		{Role: "system", Content: "Be brief."},
+		turn("user", "u1"), turn("assistant", "a1"),
+		turn("user", "u2"), turn("assistant", "a2"),
+		turn("user", "u3"),
+	}
+	trimmed, report, err := fitMessagesToContext(context.Background(), messages, "test/unknown-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range trimmed {
+		got = append(got, strings.Fields(msg.Content)[0])
+	}
+	if want := "Be u2 a2 u3"; strings.Join(got, " ") != want {
+		t.Errorf("kept %v, want %s", got, want)
+	}
+	if report.DroppedMessages != 2 || report.TokensAfter > report.BudgetTokens {
+		t.Errorf("report = %+v", report)
+	}
+	if tokens, _ := countMessagesTokens("test/unknown-model", trimmed); tokens != report.TokensAfter {
+		t.Errorf("report says %d tokens after trimming, messages have %d", report.TokensAfter, tokens)
+	}
+}
+
+func TestDropOldestKeepsToolCallsWithResults(t *testing.T) {
+	toolCalls := []byte(`[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]`)
+	entry := func(msg chatMessage, pinned bool) contextEntry {
+		return contextEntry{msg: msg, tokens: 100, pinned: pinned}
+	}
+	tests := []struct {
+		name   string
+		budget int
+		want   string
+	}{
+		{"under budget", 1000, "user assistant tool assistant user assistant user"},
+		{"drops the user turn with its tool calls", 400, "user assistant user"},
+		{"nothing left to drop", 0, "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := []contextEntry{
+				entry(turn("user", "u1"), false),
+				entry(chatMessage{Role: "assistant", ToolCalls: toolCalls}, false),
+				entry(chatMessage{Role: "tool", ToolCallID: "call_1", Content: "result"}, false),
+				entry(turn("assistant", "a1"), false),
+				entry(turn("user", "u2"), false),
+				entry(turn("assistant", "a2"), false),
+				entry(turn("user", "u3"), true),
+			}
+			kept, dropped := dropOldestEntries(entries, tt.budget)
+			var roles []string
+			for _, e := range kept {
+				roles = append(roles, e.msg.Role)
+			}
+			if got := strings.Join(roles, " "); got != tt.want {
+				t.Errorf("kept %s, want %s", got, tt.want)
+			}
+			if dropped != 7-len(kept) {
+				t.Errorf("dropped = %d, want %d", dropped, 7-len(kept))
+			}
+		})
+	}
+
+	// Dropping must never leave a tool result whose call was removed
+	entries := []contextEntry{
+		entry(chatMessage{Role: "assistant", ToolCalls: toolCalls}, false),
+		entry(chatMessage{Role: "tool", ToolCallID: "call_1", Content: "result"}, false),
+		entry(turn("user", "u2"), true),
+	}
+	if kept, _ := dropOldestEntries(entries, 150); len(kept) != 1 || kept[0].msg.Role != "user" {
+		t.Errorf("kept %d entries starting with %s, want only the pinned user message", len(kept), kept[0].msg.Role)
+	}
+}
+
+func TestSummarizeFitsSummaryModel(t *testing.T) {
+	withContextSettings(t, 350, contextStrategySummarize)
+	contextSettings.SummaryModel = "test/summary-model"
+	contextSettings.SummaryKeepRecent = 0
+	stub := newStubOpenRouter(t, "They talked.")
+
+	var entries []contextEntry
+	for _, label := range []string{"u1", "a1", "u2", "a2", "u3", "a3"} {
+		role := "user"
+		if label[0] == 'a' {
+			role = "assistant"
+		}
+		msg := turn(role, label)
+		entries = append(entries, contextEntry{msg: msg, tokens: countMessageTokens("test/unknown-model", msg)})
+	}
+	entries = append(entries, contextEntry{msg: turn("user", "u4"), tokens: 104, pinned: true})
+
+	result, summarized := summarizeOldestEntries(context.Background(), entries, "test/unknown-model")
+	if summarized != 6 || len(result) != 2 || !strings.Contains(result[0].msg.Content, "They talked.") {
+		t.Fatalf("summarized %d, result %+v", summarized, result)
+	}
+	requests := stub.received()
+	if len(requests) != 1 {
+		t.Fatalf("summary model called %d times, want once", len(requests))
+	}
+	prompt := requests[0].Messages[0].Content
+	if tokens, _ := countTextTokens("test/summary-model", prompt); tokens > contextBudgetTokens("test/summary-model") {
+		t.Errorf("summary prompt has %d tokens, budget %d", tokens, contextBudgetTokens("test/summary-model"))
+	}
+	if !strings.Contains(prompt, "earlier messages omitted") || !strings.Contains(prompt, "assistant: a3") || strings.Contains(prompt, "user: u1") {
+		t.Errorf("prompt should keep the newest messages and note the omitted ones:\n%s", prompt)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversation is a stored chat history.
+type conversation struct {
+	ID        string          `json:"id"`
+	Title     string          `json:"title"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Messages  []storedMessage `json:"messages,omitempty"`
+}
+
+// conversationSummary is a conversation without its messages, as returned by the list endpoint.
+type conversationSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int       `json:"message_count"`
+}
+
+// storedMessage is one turn of a conversation. Content holds the text; multimodal parts and
+// tool use are kept as sent, so the turn is replayed to the model unchanged. Assistant turns
+// record the model and classification that produced them.
+type storedMessage struct {
+	Role           string            `json:"role"`
+	Content        string            `json:"content"`
+	Parts          []json.RawMessage `json:"content_parts,omitempty"`
+	ToolCalls      json.RawMessage   `json:"tool_calls,omitempty"`
+	ToolCallID     string            `json:"tool_call_id,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	Classification string            `json:"classification,omitempty"`
+	RequestID      string            `json:"request_id,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// conversationStore persists conversations. Each conversation belongs to the API key (by name)
+// that created it, and every method only sees the owner's conversations. The file implementation
+// is the default; the SQL implementation is used for SQLite in builds with -tags sqlite.
+type conversationStore interface {
+	CreateConversation(ctx context.Context, owner, title string, messages []storedMessage) (conversation, error)
+	GetConversation(ctx context.Context, owner, id string) (conversation, error)
+	ListConversations(ctx context.Context, owner string, limit, offset int) ([]conversationSummary, error)
+	DeleteConversation(ctx context.Context, owner, id string) error
+	AppendMessages(ctx context.Context, owner, id string, messages []storedMessage) error
+}
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// conversations is the active store; nil when storage is disabled.
+var conversations conversationStore
+
+// initConversationStore opens the store selected by CONVERSATION_STORE: "file" (the default, one
+// JSON file per conversation in CONVERSATION_DIR), "sqlite" (at CONVERSATION_DB_PATH, needs a
+// build with -tags sqlite) or "none" to disable storage.
+func initConversationStore() error {
+	switch kind := strings.ToLower(envString("CONVERSATION_STORE", "file")); kind {
+	case "none":
+		slog.Info("Conversation storage disabled")
+		return nil
+	case "file":
+		dir := envString("CONVERSATION_DIR", "conversations")
+		store, err := openFileConversationStore(dir)
+		if err != nil {
+			return fmt.Errorf("failed to open conversation directory %s: %w", dir, err)
+		}
+		conversations = store
+		slog.Info("Storing conversations in files", "dir", dir)
+		return nil
+	case "sqlite":
+		if !sqliteLinked() {
+			return errors.New("CONVERSATION_STORE=sqlite requires a build with -tags sqlite")
+		}
+		path := envString("CONVERSATION_DB_PATH", "conversations.db")
+		store, err := openSQLiteConversationStore(path)
+		if err != nil {
+			return fmt.Errorf("failed to open conversation database %s: %w", path, err)
+		}
+		conversations = store
+		slog.Info("Storing conversations in SQLite", "path", path)
+		return nil
+	default:
+		return fmt.Errorf("unknown CONVERSATION_STORE %q", kind)
+	}
+}
+
+// fileConversationStore implements conversationStore with one JSON file per conversation.
+// Writes replace the file atomically; a mutex serializes them within the process, so the
+// directory must not be shared between instances.
+type fileConversationStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// fileConversation is the on-disk form of a conversation.
+type fileConversation struct {
+	conversation
+	Owner string `json:"api_key"`
+}
+
+// openFileConversationStore opens (creating if needed) the directory at dir.
+func openFileConversationStore(dir string) (*fileConversationStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileConversationStore{dir: dir}, nil
+}
+
+// conversationIDRe matches the IDs randomID produces.
+var conversationIDRe = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// path returns the file of conversation id, or "" for IDs randomID can't produce, which keeps
+// client-supplied IDs from escaping the directory.
+func (s *fileConversationStore) path(id string) string {
+	if !conversationIDRe.MatchString(id) {
+		return ""
+	}
+	return filepath.Join(s.dir, id+".json")
+}
+
+// load reads conversation id; errConversationNotFound unless it exists and belongs to owner.
+// Must be called with s.mu held.
+func (s *fileConversationStore) load(owner, id string) (fileConversation, error) {
+	path := s.path(id)
+	if path == "" {
+		return fileConversation{}, errConversationNotFound
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileConversation{}, errConversationNotFound
+	}
+	if err != nil {
+		return fileConversation{}, err
+	}
+	var conv fileConversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return fileConversation{}, fmt.Errorf("conversation file %s: %w", path, err)
+	}
+	if conv.Owner != owner {
+		return fileConversation{}, errConversationNotFound
+	}
+	return conv, nil
+}
+
+// save writes conv to a temporary file and renames it into place. Must be called with s.mu held.
+func (s *fileConversationStore) save(conv fileConversation) error {
+	tmp, err := os.CreateTemp(s.dir, conv.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(conv); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(conv.ID))
+}
+
+func (s *fileConversationStore) CreateConversation(ctx context.Context, owner, title string, messages []storedMessage) (conversation, error) {
+	now := time.Now().UTC()
+	conv := conversation{ID: randomID(), Title: title, CreatedAt: now, UpdatedAt: now, Messages: messages}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(fileConversation{conversation: conv, Owner: owner}); err != nil {
+		return conversation{}, err
+	}
+	return conv, nil
+}
+
+func (s *fileConversationStore) GetConversation(ctx context.Context, owner, id string) (conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, err := s.load(owner, id)
+	return conv.conversation, err
+}
+
+func (s *fileConversationStore) ListConversations(ctx context.Context, owner string, limit, offset int) ([]conversationSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	summaries := []conversationSummary{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		conv, err := s.load(owner, id)
+		if errors.Is(err, errConversationNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, conversationSummary{ID: conv.ID, Title: conv.Title,
+			CreatedAt: conv.CreatedAt, UpdatedAt: conv.UpdatedAt, MessageCount: len(conv.Messages)})
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt) })
+	if offset >= len(summaries) {
+		return []conversationSummary{}, nil
+	}
+	summaries = summaries[offset:]
+	if len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries, nil
+}
+
+func (s *fileConversationStore) DeleteConversation(ctx context.Context, owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.load(owner, id); err != nil {
+		return err
+	}
+	return os.Remove(s.path(id))
+}
+
+func (s *fileConversationStore) AppendMessages(ctx context.Context, owner, id string, messages []storedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, err := s.load(owner, id)
+	if err != nil {
+		return err
+	}
+	conv.Messages = append(conv.Messages, messages...)
+	conv.UpdatedAt = time.Now().UTC()
+	return s.save(conv)
+}
+
+// sqliteLinked reports whether sqlite.go registered the SQLite driver.
+func sqliteLinked() bool {
+	for _, name := range sql.Drivers() {
+		if name == "sqlite" {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlConversationStore implements conversationStore on database/sql.
+type sqlConversationStore struct {
+	db *sql.DB
+}
+
+const conversationSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id         TEXT PRIMARY KEY,
+	api_key    TEXT NOT NULL DEFAULT '',
+	title      TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS conversation_messages (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	conversation_id TEXT NOT NULL REFERENCES conversations(id),
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	model           TEXT NOT NULL DEFAULT '',
+	classification  TEXT NOT NULL DEFAULT '',
+	request_id      TEXT NOT NULL DEFAULT '',
+	message         TEXT NOT NULL DEFAULT '', -- The full chat message as JSON
+	created_at      TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS conversations_api_key ON conversations(api_key, updated_at);
+CREATE INDEX IF NOT EXISTS conversation_messages_conversation_id ON conversation_messages(conversation_id, id);
+`
+
+// openSQLiteConversationStore opens (creating if needed) the SQLite database at path.
+// The driver is registered in sqlite.go.
+func openSQLiteConversationStore(path string) (*sqlConversationStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serializing connections avoids SQLITE_BUSY under load.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(conversationSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlConversationStore{db: db}, nil
+}
+
+func (s *sqlConversationStore) CreateConversation(ctx context.Context, owner, title string, messages []storedMessage) (conversation, error) {
+	now := time.Now().UTC()
+	conv := conversation{ID: randomID(), Title: title, CreatedAt: now, UpdatedAt: now}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return conversation{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO conversations (id, api_key, title, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		conv.ID, owner, conv.Title, conv.CreatedAt, conv.UpdatedAt); err != nil {
+		return conversation{}, err
+	}
+	if err := insertMessages(ctx, tx, conv.ID, messages); err != nil {
+		return conversation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return conversation{}, err
+	}
+	conv.Messages = messages
+	return conv, nil
+}
+
+func (s *sqlConversationStore) GetConversation(ctx context.Context, owner, id string) (conversation, error) {
+	var conv conversation
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, title, created_at, updated_at FROM conversations WHERE id = ? AND api_key = ?`, id, owner).
+		Scan(&conv.ID, &conv.Title, &conv.CreatedAt, &conv.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return conversation{}, errConversationNotFound
+	}
+	if err != nil {
+		return conversation{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT role, content, message, model, classification, request_id, created_at
+		 FROM conversation_messages WHERE conversation_id = ? ORDER BY id`, id)
+	if err != nil {
+		return conversation{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m storedMessage
+		var message string
+		if err := rows.Scan(&m.Role, &m.Content, &message, &m.Model, &m.Classification, &m.RequestID, &m.CreatedAt); err != nil {
+			return conversation{}, err
+		}
+		if message != "" {
+			var full chatMessage
+			if err := json.Unmarshal([]byte(message), &full); err != nil {
+				return conversation{}, fmt.Errorf("stored message of conversation %s: %w", id, err)
+			}
+			m.Parts, m.ToolCalls, m.ToolCallID = full.Parts, full.ToolCalls, full.ToolCallID
+		}
+		conv.Messages = append(conv.Messages, m)
+	}
+	return conv, rows.Err()
+}
+
+func (s *sqlConversationStore) ListConversations(ctx context.Context, owner string, limit, offset int) ([]conversationSummary, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT c.id, c.title, c.created_at, c.updated_at,
+		        (SELECT COUNT(*) FROM conversation_messages m WHERE m.conversation_id = c.id)
+		 FROM conversations c WHERE c.api_key = ? ORDER BY c.updated_at DESC LIMIT ? OFFSET ?`, owner, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	summaries := []conversationSummary{}
+	for rows.Next() {
+		var c conversationSummary
+		if err := rows.Scan(&c.ID, &c.Title, &c.CreatedAt, &c.UpdatedAt, &c.MessageCount); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, c)
+	}
+	return summaries, rows.Err()
+}
+
+func (s *sqlConversationStore) DeleteConversation(ctx context.Context, owner, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM conversations WHERE id = ? AND api_key = ?`, id, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errConversationNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM conversation_messages WHERE conversation_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlConversationStore) AppendMessages(ctx context.Context, owner, id string, messages []storedMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE conversations SET updated_at = ? WHERE id = ? AND api_key = ?`, time.Now().UTC(), id, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errConversationNotFound
+	}
+	if err := insertMessages(ctx, tx, id, messages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMessages writes messages to a conversation within tx.
+func insertMessages(ctx context.Context, tx *sql.Tx, conversationID string, messages []storedMessage) error {
+	for _, m := range messages {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO conversation_messages (conversation_id, role, content, message, model, classification, request_id, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			conversationID, m.Role, m.Content, string(mustJSON(m.chatMessage())), m.Model, m.Classification, m.RequestID, m.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toStoredMessages converts request messages to stored turns.
+func toStoredMessages(messages []chatMessage, requestID string) []storedMessage {
+	now := time.Now().UTC()
+	stored := make([]storedMessage, 0, len(messages))
+	for _, m := range messages {
+		stored = append(stored, storedMessage{Role: m.Role, Content: m.Content, Parts: m.Parts, ToolCalls: m.ToolCalls,
+			ToolCallID: m.ToolCallID, RequestID: requestID, CreatedAt: now})
+	}
+	return stored
+}
+
+// chatMessage returns the message as forwarded to the model.
+func (m storedMessage) chatMessage() chatMessage {
+	return chatMessage{Role: m.Role, Content: m.Content, Parts: m.Parts, ToolCalls: m.ToolCalls, ToolCallID: m.ToolCallID}
+}
+
+// toChatMessages converts stored turns to the messages forwarded to the model.
+func toChatMessages(messages []storedMessage) []chatMessage {
+	out := make([]chatMessage, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, m.chatMessage())
+	}
+	return out
+}
+
+// conversationOwner returns the name of the request's API key, which owns the conversations it
+// creates and is the only key that can read, continue or delete them.
+func conversationOwner(ctx context.Context) string {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// conversationsHandler serves the conversation API:
+//
+//	POST   /api/conversations       create (optional "title" and initial "messages")
+//	GET    /api/conversations       list, newest first (?limit=&offset=)
+//	GET    /api/conversations/{id}  fetch with messages
+//	DELETE /api/conversations/{id}  delete
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if conversations == nil {
+		http.Error(w, "Not Implemented: Conversation storage is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/conversations"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createConversation(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		listConversations(w, r)
+	case id != "" && r.Method == http.MethodGet:
+		getConversation(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		deleteConversation(w, r, id)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createConversation(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Title    string        `json:"title"`
+		Messages []chatMessage `json:"messages"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSONBody(w, r, &body) {
+			return
+		}
+	}
+	conv, err := conversations.CreateConversation(r.Context(), conversationOwner(r.Context()), body.Title, toStoredMessages(body.Messages, ""))
+	if err != nil {
+		logFor(r.Context()).Error("Failed to create conversation", "error", err)
+		http.Error(w, "Internal Server Error: Failed to create conversation", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(conv)
+}
+
+func listConversations(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 50, 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 500 {
+		limit = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v >= 0 {
+		offset = v
+	}
+	summaries, err := conversations.ListConversations(r.Context(), conversationOwner(r.Context()), limit, offset)
+	if err != nil {
+		logFor(r.Context()).Error("Failed to list conversations", "error", err)
+		http.Error(w, "Internal Server Error: Failed to list conversations", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"conversations": summaries, "limit": limit, "offset": offset})
+}
+
+func getConversation(w http.ResponseWriter, r *http.Request, id string) {
+	conv, err := conversations.GetConversation(r.Context(), conversationOwner(r.Context()), id)
+	if errors.Is(err, errConversationNotFound) {
+		http.Error(w, "Not Found: Unknown conversation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logFor(r.Context()).Error("Failed to load conversation", "conversation_id", id, "error", err)
+		http.Error(w, "Internal Server Error: Failed to load conversation", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, conv)
+}
+
+func deleteConversation(w http.ResponseWriter, r *http.Request, id string) {
+	err := conversations.DeleteConversation(r.Context(), conversationOwner(r.Context()), id)
+	if errors.Is(err, errConversationNotFound) {
+		http.Error(w, "Not Found: Unknown conversation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logFor(r.Context()).Error("Failed to delete conversation", "conversation_id", id, "error", err)
+		http.Error(w, "Internal Server Error: Failed to delete conversation", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forEachStore runs test against the file store and, in builds with -tags sqlite, the SQLite
+// store, each in a temporary directory.
+func forEachStore(t *testing.T, test func(t *testing.T, store conversationStore)) {
+	t.Run("file", func(t *testing.T) {
+		store, err := openFileConversationStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		if !sqliteLinked() {
+			t.Skip("SQLite driver not linked, build with -tags sqlite")
+		}
+		store, err := openSQLiteConversationStore(filepath.Join(t.TempDir(), "conversations.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.db.Close() })
+		test(t, store)
+	})
+}
+
+func TestConversationsAreScopedToTheirKey(t *testing.T) {
+	forEachStore(t, testConversationsAreScopedToTheirKey)
+}
+
+func testConversationsAreScopedToTheirKey(t *testing.T, store conversationStore) {
+	ctx := context.Background()
+	conv, err := store.CreateConversation(ctx, "web", "Trip", toStoredMessages([]chatMessage{{Role: "user", Content: "Hi"}}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetConversation(ctx, "batch", conv.ID); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("other key GetConversation error = %v, want not found", err)
+	}
+	if list, err := store.ListConversations(ctx, "batch", 10, 0); err != nil || len(list) != 0 {
+		t.Errorf("other key ListConversations = %v, %v, want none", list, err)
+	}
+	if err := store.AppendMessages(ctx, "batch", conv.ID, toStoredMessages([]chatMessage{{Role: "user", Content: "x"}}, "")); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("other key AppendMessages error = %v, want not found", err)
+	}
+	if err := store.DeleteConversation(ctx, "batch", conv.ID); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("other key DeleteConversation error = %v, want not found", err)
+	}
+
+	got, err := store.GetConversation(ctx, "web", conv.ID)
+	if err != nil || len(got.Messages) != 1 {
+		t.Fatalf("owner GetConversation = %+v, %v, want the conversation with 1 message", got, err)
+	}
+	if list, err := store.ListConversations(ctx, "web", 10, 0); err != nil || len(list) != 1 || list[0].MessageCount != 1 {
+		t.Errorf("owner ListConversations = %+v, %v", list, err)
+	}
+	if err := store.DeleteConversation(ctx, "web", conv.ID); err != nil {
+		t.Errorf("owner DeleteConversation error = %v", err)
+	}
+}
+
+func TestConversationStoreKeepsFullMessages(t *testing.T) {
+	forEachStore(t, testConversationStoreKeepsFullMessages)
+}
+
+func testConversationStoreKeepsFullMessages(t *testing.T, store conversationStore) {
+	ctx := context.Background()
+	var messages []chatMessage
+	if err := json.Unmarshal([]byte(`[
+		{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]},
+		{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":"A cat."}
+	]`), &messages); err != nil {
+		t.Fatal(err)
+	}
+	conv, err := store.CreateConversation(ctx, "web", "", toStoredMessages(messages, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.GetConversation(ctx, "web", conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := toChatMessages(loaded.Messages)
+	if got, want := string(mustJSON(replayed)), string(mustJSON(messages)); got != want {
+		t.Errorf("replayed messages differ:\n got %s\nwant %s", got, want)
+	}
+}
+
+// memoryConversationStore is a conversationStore holding one conversation per ID in memory.
+type memoryConversationStore struct {
+	mu    sync.Mutex
+	convs map[string]conversation
+}
+
+func (s *memoryConversationStore) CreateConversation(ctx context.Context, owner, title string, messages []storedMessage) (conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv := conversation{ID: owner + "-" + randomID(), Title: title, Messages: messages}
+	s.convs[conv.ID] = conv
+	return conv, nil
+}
+
+func (s *memoryConversationStore) GetConversation(ctx context.Context, owner, id string) (conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, ok := s.convs[id]
+	if !ok || !strings.HasPrefix(id, owner+"-") {
+		return conversation{}, errConversationNotFound
+	}
+	return conv, nil
+}
+
+func (s *memoryConversationStore) ListConversations(ctx context.Context, owner string, limit, offset int) ([]conversationSummary, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *memoryConversationStore) DeleteConversation(ctx context.Context, owner, id string) error {
+	return errors.New("not implemented")
+}
+
+func (s *memoryConversationStore) AppendMessages(ctx context.Context, owner, id string, messages []storedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, ok := s.convs[id]
+	if !ok || !strings.HasPrefix(id, owner+"-") {
+		return errConversationNotFound
+	}
+	conv.Messages = append(conv.Messages, messages...)
+	s.convs[id] = conv
+	return nil
+}
+
+func TestConversationStoreListsNewestFirst(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store conversationStore) {
+		ctx := context.Background()
+		var ids []string
+		for _, title := range []string{"first", "second", "third"} {
+			conv, err := store.CreateConversation(ctx, "web", title, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, conv.ID)
+			time.Sleep(2 * time.Millisecond)
+		}
+		if err := store.AppendMessages(ctx, "web", ids[0], toStoredMessages([]chatMessage{{Role: "user", Content: "again"}}, "")); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := store.ListConversations(ctx, "web", 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].Title != "first" || list[0].MessageCount != 1 || list[1].Title != "third" {
+			t.Errorf("first page = %+v, want first (1 message), third", list)
+		}
+		if list, err := store.ListConversations(ctx, "web", 2, 2); err != nil || len(list) != 1 || list[0].Title != "second" {
+			t.Errorf("second page = %+v, %v, want second", list, err)
+		}
+		if list, err := store.ListConversations(ctx, "web", 2, 5); err != nil || list == nil || len(list) != 0 {
+			t.Errorf("page past the end = %#v, %v, want an empty list", list, err)
+		}
+	})
+}
+
+func TestFileConversationStoreRejectsPathIDs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileConversationStore(filepath.Join(dir, "conversations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"id":"secret","api_key":"web"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"../secret", "..", "a/b", ""} {
+		if _, err := store.GetConversation(context.Background(), "web", id); !errors.Is(err, errConversationNotFound) {
+			t.Errorf("GetConversation(%q) error = %v, want not found", id, err)
+		}
+	}
+}
+
+func TestChatStoresOnlyCompletedReplies(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    bool
+		truncate  bool
+		wantTurns int
+	}{
+		{"non-streaming", false, false, 2},
+		{"completed stream", true, false, 2},
+		{"stream cut off before [DONE]", true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := setupTestRouter(t)
+			stub := newStubOpenRouter(t, "The answer is 42.")
+			stub.truncate = tt.truncate
+			store := &memoryConversationStore{convs: make(map[string]conversation)}
+			previous := conversations
+			conversations = store
+			t.Cleanup(func() { conversations = previous })
+			conv, _ := store.CreateConversation(context.Background(), apiKeys[0].Name, "", nil)
+
+			rec := postJSON(handler, "/api/chat", string(mustJSON(map[string]interface{}{
+				"model": "x-ai/grok-3-mini-beta", "stream": tt.stream, "conversation_id": conv.ID,
+				"messages": []chatMessage{{Role: "user", Content: "What is the answer?"}},
+			})))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			stored, _ := store.GetConversation(context.Background(), apiKeys[0].Name, conv.ID)
+			if len(stored.Messages) != tt.wantTurns {
+				t.Fatalf("stored %d messages, want %d", len(stored.Messages), tt.wantTurns)
+			}
+			if tt.wantTurns > 0 && stored.Messages[1].Content != "The answer is 42." {
+				t.Errorf("stored reply %q", stored.Messages[1].Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- CORS ---
+//
+// Browsers may only call the API from the origins in CORS_ALLOWED_ORIGINS: exact origins such as
+// "https://app.example.com", or wildcard subdomains such as "https://*.example.com" (which
+// matches any subdomain, but not example.com itself). "*" allows every origin and cannot be
+// combined with CORS_ALLOW_CREDENTIALS. CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS and CORS_MAX_AGE shape the responses. corsMiddleware answers preflight
+// requests itself, so handlers only see actual requests.
+
+// corsConfig holds the CORS policy.
+type corsConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+var corsSettings = corsConfig{
+	AllowedOrigins: []string{"http://localhost:5173", "https://gmsoftwares.com", "https://*.gmsoftwares.com"},
+	AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+	AllowedHeaders: []string{"Authorization", "Content-Type", "Accept", requestIDHeader},
+	ExposedHeaders: []string{requestIDHeader},
+	MaxAge:         10 * time.Minute,
+}
+
+// originPattern is one parsed entry of CORS_ALLOWED_ORIGINS.
+type originPattern struct {
+	scheme     string
+	host       string // Includes the port, if any
+	subdomains bool   // host is the parent domain of a "*." pattern
+}
+
+var (
+	corsAllowAll bool
+	corsOrigins  []originPattern
+)
+
+// initCORS reads and validates the CORS policy.
+func initCORS() error {
+	cfg := corsSettings
+	cfg.AllowedOrigins = envList("CORS_ALLOWED_ORIGINS", cfg.AllowedOrigins)
+	cfg.AllowedMethods = envList("CORS_ALLOWED_METHODS", cfg.AllowedMethods)
+	cfg.AllowedHeaders = envList("CORS_ALLOWED_HEADERS", cfg.AllowedHeaders)
+	cfg.ExposedHeaders = envList("CORS_EXPOSED_HEADERS", cfg.ExposedHeaders)
+	cfg.AllowCredentials = envBool("CORS_ALLOW_CREDENTIALS", cfg.AllowCredentials)
+	cfg.MaxAge = envDuration("CORS_MAX_AGE", cfg.MaxAge)
+
+	corsAllowAll, corsOrigins = false, nil
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			corsAllowAll = true
+			continue
+		}
+		pattern, err := parseOriginPattern(origin)
+		if err != nil {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %w", err)
+		}
+		corsOrigins = append(corsOrigins, pattern)
+	}
+	if corsAllowAll && cfg.AllowCredentials {
+		return fmt.Errorf("CORS_ALLOWED_ORIGINS=* cannot be combined with CORS_ALLOW_CREDENTIALS")
+	}
+	corsSettings = cfg
+	slog.Info("CORS configured", "origins", cfg.AllowedOrigins, "credentials", cfg.AllowCredentials, "max_age", cfg.MaxAge.String())
+	return nil
+}
+
+func parseOriginPattern(origin string) (originPattern, error) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSuffix(origin, "/")))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return originPattern{}, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+	}
+	pattern := originPattern{scheme: u.Scheme, host: u.Host}
+	if parent, ok := strings.CutPrefix(u.Host, "*."); ok {
+		if parent == "" || strings.Contains(parent, "*") {
+			return originPattern{}, fmt.Errorf("invalid wildcard origin %q", origin)
+		}
+		pattern.host, pattern.subdomains = parent, true
+	} else if strings.Contains(u.Host, "*") {
+		return originPattern{}, fmt.Errorf("invalid wildcard origin %q, only a leading \"*.\" is supported", origin)
+	}
+	return pattern, nil
+}
+
+// originAllowed reports whether a browser on origin may call the API.
+func originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if corsAllowAll {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, p := range corsOrigins {
+		if p.scheme != u.Scheme {
+			continue
+		}
+		if u.Host == p.host && !p.subdomains {
+			return true
+		}
+		if p.subdomains && strings.HasSuffix(u.Host, "."+p.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware applies the CORS policy to every request and answers preflight requests.
+// Requests from other origins are served without CORS headers, so browsers block the response.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		h := w.Header()
+		if !corsAllowAll {
+			h.Add("Vary", "Origin") // The response depends on the origin, so caches must key on it
+		}
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowed := originAllowed(origin)
+		if allowed {
+			if corsAllowAll {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if corsSettings.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		} else if origin != "" {
+			logFor(r.Context()).Debug("Origin not allowed by CORS policy", "origin", origin, "path", r.URL.Path)
+		}
+
+		if !preflight {
+			if allowed && len(corsSettings.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(corsSettings.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed {
+			h.Set("Access-Control-Allow-Methods", strings.Join(corsSettings.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(corsSettings.AllowedHeaders, ", "))
+			if corsSettings.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsSettings.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withCORS(t *testing.T, origins ...string) {
+	t.Helper()
+	t.Setenv("CORS_ALLOWED_ORIGINS", strings.Join(origins, ","))
+	previous, previousAll, previousOrigins := corsSettings, corsAllowAll, corsOrigins
+	t.Cleanup(func() { corsSettings, corsAllowAll, corsOrigins = previous, previousAll, previousOrigins })
+	if err := initCORS(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	withCORS(t, "https://app.example.com", "https://*.example.org", "http://localhost:5173")
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		preflight     bool
+		wantCode      int
+		wantOrigin    string
+		wantNextCalls bool
+	}{
+		{"exact origin", http.MethodPost, "https://app.example.com", false, 200, "https://app.example.com", true},
+		{"wildcard subdomain", http.MethodGet, "https://a.b.example.org", false, 200, "https://a.b.example.org", true},
+		{"wildcard excludes parent", http.MethodGet, "https://example.org", false, 200, "", true},
+		{"look-alike domain", http.MethodGet, "https://app.example.com.evil.com", false, 200, "", true},
+		{"suffix without dot", http.MethodGet, "https://evilexample.org", false, 200, "", true},
+		{"scheme must match", http.MethodGet, "http://app.example.com", false, 200, "", true},
+		{"port must match", http.MethodGet, "http://localhost:3000", false, 200, "", true},
+		{"no origin", http.MethodGet, "", false, 200, "", true},
+		{"preflight allowed", http.MethodOptions, "https://app.example.com", true, 204, "https://app.example.com", false},
+		{"preflight denied", http.MethodOptions, "https://evil.com", true, 204, "", false},
+		{"plain OPTIONS passes through", http.MethodOptions, "", false, 200, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+			req := httptest.NewRequest(tt.method, "/api/chat", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			corsMiddleware(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if called != tt.wantNextCalls {
+				t.Errorf("next called = %v, want %v", called, tt.wantNextCalls)
+			}
+			if !containsValue(rec.Header().Values("Vary"), "Origin") {
+				t.Errorf("Vary = %v, want it to include Origin", rec.Header().Values("Vary"))
+			}
+			if tt.preflight && tt.wantOrigin != "" && rec.Header().Get("Access-Control-Max-Age") == "" {
+				t.Errorf("allowed preflight without Access-Control-Max-Age")
+			}
+		})
+	}
+}
+
+func TestCORSConfigValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     string
+		credentials string
+		wantErr     bool
+	}{
+		{"valid", "https://a.example.com,https://*.example.org", "", false},
+		{"any origin", "*", "", false},
+		{"any origin with credentials", "*", "true", true},
+		{"path not allowed", "https://example.com/app", "", true},
+		{"wildcard in the middle", "https://app.*.example.com", "", true},
+		{"missing scheme", "example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+			t.Setenv("CORS_ALLOW_CREDENTIALS", tt.credentials)
+			previous, previousAll, previousOrigins := corsSettings, corsAllowAll, corsOrigins
+			t.Cleanup(func() { corsSettings, corsAllowAll, corsOrigins = previous, previousAll, previousOrigins })
+			if err := initCORS(); (err != nil) != tt.wantErr {
+				t.Errorf("initCORS() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func containsValue(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// evalExample is one labeled line of an evaluation dataset (JSONL).
+// Category may be either the classificationMap key ("8") or its name ("Coding & Technical Tasks").
+type evalExample struct {
+	Prompt   string `json:"prompt"`
+	Category string `json:"category"`
+}
+
+// evalResult is the classifier outcome for a single example.
+type evalResult struct {
+	Expected  string
+	Predicted string // Empty if the classifier failed
+	Source    string // "rule" or "model"
+	Latency   time.Duration
+	Err       error
+}
+
+// evalCategoryStats holds per-category precision/recall figures.
+type evalCategoryStats struct {
+	Category  string  `json:"category"`
+	Name      string  `json:"name"`
+	Support   int     `json:"support"`
+	Predicted int     `json:"predicted"`
+	Correct   int     `json:"correct"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+// evalReport summarizes an evaluation run.
+type evalReport struct {
+	Total           int                       `json:"total"`
+	Correct         int                       `json:"correct"`
+	Errors          int                       `json:"errors"`
+	RuleHits        int                       `json:"rule_hits"`
+	Accuracy        float64                   `json:"accuracy"`
+	PerCategory     []evalCategoryStats       `json:"per_category"`
+	Confusion       map[string]map[string]int `json:"confusion_matrix"` // expected -> predicted -> count
+	LatencyMillis   map[string]float64        `json:"latency_ms"`
+	ClassifierModel string                    `json:"classifier_model"`
+	OllamaURL       string                    `json:"ollama_url"`
+}
+
+// evalInvalidLabel is used in the confusion matrix for errors and out-of-range answers.
+const evalInvalidLabel = "invalid"
+
+// runEvalCommand implements the "eval" subcommand and returns the process exit code.
+//
+//	backend eval -dataset labeled.jsonl [-ollama-url URL] [-model gemma3:4b] [-rules] [-concurrency 4] [-json]
+func runEvalCommand(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	datasetPath := fs.String("dataset", "", "Path to a JSONL file with {\"prompt\", \"category\"} lines (required)")
+	ollamaURLFlag := fs.String("ollama-url", ollamaURL, "Ollama generate endpoint used for classification")
+	modelFlag := fs.String("model", classificationModel, "Ollama model used for classification")
+	useRules := fs.Bool("rules", true, "Evaluate the rule-based pre-classifier in front of the model")
+	concurrency := fs.Int("concurrency", 1, "Number of prompts classified in parallel")
+	jsonOutput := fs.Bool("json", false, "Print the report as JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *datasetPath == "" {
+		fmt.Fprintln(os.Stderr, "eval: -dataset is required")
+		fs.Usage()
+		return 2
+	}
+
+	ollamaURL = *ollamaURLFlag
+	classificationModel = *modelFlag
+	if *useRules {
+		if err := loadClassificationRules(); err != nil {
+			fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+			return 1
+		}
+	} else {
+		classificationRules = nil
+	}
+
+	f, err := os.Open(*datasetPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	examples, err := readEvalDataset(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return 1
+	}
+
+	slog.Info("Evaluating examples", "examples", len(examples), "model", classificationModel, "url", ollamaURL)
+	results := runEvaluation(examples, classifyForEval, *concurrency)
+	report := buildEvalReport(results)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+			return 1
+		}
+	} else {
+		printEvalReport(os.Stdout, report)
+	}
+	return 0
+}
+
+// readEvalDataset parses a JSONL dataset, resolving category names to classificationMap keys.
+func readEvalDataset(r io.Reader) ([]evalExample, error) {
+	var examples []evalExample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var ex evalExample
+		if err := json.Unmarshal([]byte(line), &ex); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		category, ok := resolveCategory(ex.Category)
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown category %q", lineNo, ex.Category)
+		}
+		ex.Category = category
+		examples = append(examples, ex)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(examples) == 0 {
+		return nil, fmt.Errorf("dataset is empty")
+	}
+	return examples, nil
+}
+
+// resolveCategory accepts a classificationMap key or a category name (case-insensitive).
+func resolveCategory(category string) (string, bool) {
+	category = strings.TrimSpace(category)
+	if _, ok := classificationMap[category]; ok {
+		return category, true
+	}
+	for key, info := range classificationMap {
+		if strings.EqualFold(info.Name, category) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// classifyForEval runs the same pipeline as chatHandler in auto mode (rules, then the model),
+// bypassing the classification cache so every example hits the classifier.
+func classifyForEval(prompt string) (string, string, error) {
+	if match, ok := matchClassificationRule(prompt); ok {
+		return match.Category, "rule", nil
+	}
+	category, err := classifyPrompt(context.Background(), prompt)
+	return category, "model", err
+}
+
+// runEvaluation classifies every example with the given classifier using up to concurrency workers.
+func runEvaluation(examples []evalExample, classify func(string) (string, string, error), concurrency int) []evalResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]evalResult, len(examples))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				predicted, source, err := classify(examples[i].Prompt)
+				results[i] = evalResult{
+					Expected:  examples[i].Category,
+					Predicted: predicted,
+					Source:    source,
+					Latency:   time.Since(start),
+					Err:       err,
+				}
+			}
+		}()
+	}
+	for i := range examples {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// buildEvalReport computes accuracy, per-category precision/recall, the confusion matrix
+// and latency percentiles from the individual results.
+func buildEvalReport(results []evalResult) evalReport {
+	report := evalReport{
+		Total:           len(results),
+		Confusion:       make(map[string]map[string]int),
+		ClassifierModel: classificationModel,
+		OllamaURL:       ollamaURL,
+	}
+	predictedCount := make(map[string]int)
+	supportCount := make(map[string]int)
+	correctCount := make(map[string]int)
+	latencies := make([]time.Duration, 0, len(results))
+
+	for _, res := range results {
+		latencies = append(latencies, res.Latency)
+		predicted := res.Predicted
+		if res.Err != nil {
+			report.Errors++
+			predicted = evalInvalidLabel
+		} else if _, ok := classificationMap[predicted]; !ok {
+			predicted = evalInvalidLabel
+		}
+		if res.Source == "rule" {
+			report.RuleHits++
+		}
+
+		supportCount[res.Expected]++
+		predictedCount[predicted]++
+		if report.Confusion[res.Expected] == nil {
+			report.Confusion[res.Expected] = make(map[string]int)
+		}
+		report.Confusion[res.Expected][predicted]++
+		if predicted == res.Expected {
+			report.Correct++
+			correctCount[predicted]++
+		}
+	}
+	if report.Total > 0 {
+		report.Accuracy = float64(report.Correct) / float64(report.Total)
+	}
+
+	for _, key := range sortedCategoryKeys() {
+		stats := evalCategoryStats{
+			Category:  key,
+			Name:      classificationMap[key].Name,
+			Support:   supportCount[key],
+			Predicted: predictedCount[key],
+			Correct:   correctCount[key],
+		}
+		if stats.Predicted > 0 {
+			stats.Precision = float64(stats.Correct) / float64(stats.Predicted)
+		}
+		if stats.Support > 0 {
+			stats.Recall = float64(stats.Correct) / float64(stats.Support)
+		}
+		if stats.Precision+stats.Recall > 0 {
+			stats.F1 = 2 * stats.Precision * stats.Recall / (stats.Precision + stats.Recall)
+		}
+		report.PerCategory = append(report.PerCategory, stats)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.LatencyMillis = map[string]float64{
+		"p50": durationMillis(latencyPercentile(latencies, 50)),
+		"p90": durationMillis(latencyPercentile(latencies, 90)),
+		"p95": durationMillis(latencyPercentile(latencies, 95)),
+		"p99": durationMillis(latencyPercentile(latencies, 99)),
+		"max": durationMillis(latencyPercentile(latencies, 100)),
+	}
+	return report
+}
+
+// latencyPercentile returns the nearest-rank percentile of sorted latencies.
+func latencyPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// sortedCategoryKeys returns the classificationMap keys in numeric order.
+func sortedCategoryKeys() []string {
+	keys := make([]string, 0, len(classificationMap))
+	for key := range classificationMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// printEvalReport writes a human-readable report.
+func printEvalReport(out io.Writer, report evalReport) {
+	fmt.Fprintf(out, "Classifier: %s (%s)\n", report.ClassifierModel, report.OllamaURL)
+	fmt.Fprintf(out, "Examples: %d  Correct: %d  Errors: %d  Rule hits: %d\n", report.Total, report.Correct, report.Errors, report.RuleHits)
+	fmt.Fprintf(out, "Accuracy: %.2f%%\n\n", report.Accuracy*100)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CATEGORY\tNAME\tSUPPORT\tPRECISION\tRECALL\tF1")
+	for _, stats := range report.PerCategory {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.3f\t%.3f\t%.3f\n", stats.Category, stats.Name, stats.Support, stats.Precision, stats.Recall, stats.F1)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(out, "\nConfusion matrix (rows = expected, columns = predicted):")
+	columns := append(sortedCategoryKeys(), evalInvalidLabel)
+	tw = tabwriter.NewWriter(out, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "\t")
+	for _, col := range columns {
+		fmt.Fprintf(tw, "%s\t", col)
+	}
+	fmt.Fprintln(tw)
+	for _, row := range sortedCategoryKeys() {
+		fmt.Fprintf(tw, "%s\t", row)
+		for _, col := range columns {
+			fmt.Fprintf(tw, "%d\t", report.Confusion[row][col])
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(out, "\nLatency (ms): p50=%.1f p90=%.1f p95=%.1f p99=%.1f max=%.1f\n",
+		report.LatencyMillis["p50"], report.LatencyMillis["p90"], report.LatencyMillis["p95"],
+		report.LatencyMillis["p99"], report.LatencyMillis["max"])
+}
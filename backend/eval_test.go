@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// evalFixture is a small labelled dataset; stubAnswers is what the stubbed Ollama answers for a
+// prompt containing each key.
+const evalFixture = `{"prompt": "fix the bug in my python script", "category": "8"}
+{"prompt": "write a poem about autumn", "category": "Creative & Artistic"}
+{"prompt": "hello there friend", "category": "10"}
+{"prompt": "explain how photosynthesis works", "category": "5"}
+{"prompt": "plan my company's market entry", "category": "3"}
+`
+
+var stubAnswers = map[string]string{
+	"python script":  "8",
+	"poem":           "9",
+	"hello there":    "10",
+	"photosynthesis": "1",      // Wrong: expected 5
+	"market entry":   "banana", // Not a category
+}
+
+// newStubOllama serves canned classifications from the /api/generate endpoint.
+func newStubOllama(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Prompt string `json:"prompt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for marker, answer := range stubAnswers {
+			if strings.Contains(req.Prompt, marker) {
+				json.NewEncoder(w).Encode(ollamaResponse{Response: answer + "\n", Done: true})
+				return
+			}
+		}
+		http.Error(w, "no canned answer", http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runEvalForTest runs the eval command against the stub and returns its standard output.
+func runEvalForTest(t *testing.T, extraArgs ...string) string {
+	t.Helper()
+	previousURL, previousModel, previousRules := ollamaURL, classificationModel, classificationRules
+	t.Cleanup(func() {
+		ollamaURL, classificationModel, classificationRules = previousURL, previousModel, previousRules
+	})
+
+	dataset := filepath.Join(t.TempDir(), "labelled.jsonl")
+	if err := os.WriteFile(dataset, []byte(evalFixture), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ollama := newStubOllama(t)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	args := append([]string{"-dataset", dataset, "-ollama-url", ollama.URL + "/api/generate", "-rules=false", "-concurrency", "2"}, extraArgs...)
+	code := runEvalCommand(args)
+	w.Close()
+	os.Stdout = stdout
+	out, _ := io.ReadAll(r)
+	if code != 0 {
+		t.Fatalf("eval exited with %d: %s", code, out)
+	}
+	return string(out)
+}
+
+func TestEvalCommandJSONReport(t *testing.T) {
+	var report evalReport
+	if err := json.Unmarshal([]byte(runEvalForTest(t, "-json")), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 5 || report.Correct != 3 || report.Errors != 0 || report.RuleHits != 0 {
+		t.Errorf("total/correct/errors/rule hits = %d/%d/%d/%d, want 5/3/0/0", report.Total, report.Correct, report.Errors, report.RuleHits)
+	}
+	if report.Accuracy != 0.6 {
+		t.Errorf("accuracy = %v, want 0.6", report.Accuracy)
+	}
+
+	wantConfusion := map[string]map[string]int{
+		"8":  {"8": 1},
+		"9":  {"9": 1},
+		"10": {"10": 1},
+		"5":  {"1": 1},
+		"3":  {evalInvalidLabel: 1},
+	}
+	if len(report.Confusion) != len(wantConfusion) {
+		t.Errorf("confusion matrix has %d rows, want %d: %v", len(report.Confusion), len(wantConfusion), report.Confusion)
+	}
+	for expected, row := range wantConfusion {
+		for predicted, count := range row {
+			if got := report.Confusion[expected][predicted]; got != count {
+				t.Errorf("confusion[%s][%s] = %d, want %d", expected, predicted, got, count)
+			}
+		}
+	}
+
+	for _, stats := range report.PerCategory {
+		switch stats.Category {
+		case "8", "9", "10":
+			if stats.Precision != 1 || stats.Recall != 1 {
+				t.Errorf("category %s precision/recall = %v/%v, want 1/1", stats.Category, stats.Precision, stats.Recall)
+			}
+		case "1": // Predicted once, never expected
+			if stats.Predicted != 1 || stats.Precision != 0 {
+				t.Errorf("category 1 predicted/precision = %d/%v, want 1/0", stats.Predicted, stats.Precision)
+			}
+		case "5", "3":
+			if stats.Support != 1 || stats.Recall != 0 {
+				t.Errorf("category %s support/recall = %d/%v, want 1/0", stats.Category, stats.Support, stats.Recall)
+			}
+		}
+	}
+}
+
+func TestEvalCommandTableReport(t *testing.T) {
+	out := runEvalForTest(t)
+	for _, want := range []string{"Examples: 5  Correct: 3  Errors: 0", "Accuracy: 60.00%", "Confusion matrix"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- A/B experiments on routing tables ---
+//
+// An experiment overrides the routes of some categories for a share of traffic. Each variant has
+// a weight in percent; traffic outside the weights isn't enrolled. Units (API keys or
+// conversations) are hashed with the experiment name, so a unit always gets the same variant.
+// Only requests classified into a category some variant overrides are enrolled, so a variant
+// without routes is the control group for exactly those categories.
+
+// Experiment assignment units.
+const (
+	experimentUnitAPIKey       = "api_key"
+	experimentUnitConversation = "conversation" // Falls back to the API key without a conversation_id
+)
+
+// categoryRoute replaces a classificationMap entry's Model and Candidates.
+type categoryRoute struct {
+	Model      string   `json:"model"`
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+type experimentVariant struct {
+	Name   string                   `json:"name"`
+	Weight float64                  `json:"weight"`           // Percent of units
+	Routes map[string]categoryRoute `json:"routes,omitempty"` // Category key -> route
+}
+
+type experiment struct {
+	Name     string              `json:"name"`
+	Unit     string              `json:"unit"`
+	Variants []experimentVariant `json:"variants"`
+
+	categories map[string]bool // Categories any variant overrides
+}
+
+// experimentAssignment tags a request with its experiment variant.
+type experimentAssignment struct {
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
+}
+
+// variantStats are per-variant counters since startup.
+type variantStats struct {
+	Requests     int     `json:"requests"`
+	Failed       int     `json:"failed"`
+	FeedbackUp   int     `json:"feedback_up"`
+	FeedbackDown int     `json:"feedback_down"`
+	TotalMS      int64   `json:"-"`
+	AvgMS        float64 `json:"avg_duration_ms"`
+	TotalCostUSD float64 `json:"estimated_cost_usd"`
+	AvgCostUSD   float64 `json:"avg_estimated_cost_usd"`
+}
+
+var (
+	experiments     []*experiment
+	experimentMu    sync.Mutex
+	experimentStats = make(map[experimentAssignment]*variantStats)
+)
+
+// initExperiments loads experiments from EXPERIMENTS_FILE (a JSON array of experiment).
+func initExperiments() error {
+	path := envString("EXPERIMENTS_FILE", "")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read experiments file: %w", err)
+	}
+	var list []*experiment
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse experiments file %s: %w", path, err)
+	}
+
+	owner := make(map[string]string) // Category -> experiment overriding it
+	for _, exp := range list {
+		if exp.Name == "" {
+			return fmt.Errorf("experiment without a name in %s", path)
+		}
+		switch exp.Unit {
+		case "":
+			exp.Unit = experimentUnitConversation
+		case experimentUnitAPIKey, experimentUnitConversation:
+		default:
+			return fmt.Errorf("experiment %s: unknown unit %q", exp.Name, exp.Unit)
+		}
+		exp.categories = make(map[string]bool)
+		var total float64
+		seen := make(map[string]bool)
+		for _, variant := range exp.Variants {
+			if variant.Name == "" || seen[variant.Name] {
+				return fmt.Errorf("experiment %s: variants need unique names", exp.Name)
+			}
+			seen[variant.Name] = true
+			if variant.Weight < 0 {
+				return fmt.Errorf("experiment %s: variant %s has a negative weight", exp.Name, variant.Name)
+			}
+			total += variant.Weight
+			for category, route := range variant.Routes {
+				if _, ok := classificationMap[category]; !ok {
+					return fmt.Errorf("experiment %s: unknown category %q", exp.Name, category)
+				}
+				for _, model := range append([]string{route.Model}, route.Candidates...) {
+					if err := models.Validate(model); err != nil {
+						return fmt.Errorf("experiment %s, variant %s: %w", exp.Name, variant.Name, err)
+					}
+				}
+				exp.categories[category] = true
+			}
+		}
+		if total > 100 {
+			return fmt.Errorf("experiment %s: variant weights add up to %g%%", exp.Name, total)
+		}
+		for category := range exp.categories {
+			if other, ok := owner[category]; ok {
+				return fmt.Errorf("experiments %s and %s both override category %s", other, exp.Name, category)
+			}
+			owner[category] = exp.Name
+		}
+		switch {
+		case len(apiKeys) >= 2:
+		case exp.Unit == experimentUnitAPIKey:
+			slog.Warn("Experiment is split by API key but only one key is configured, all traffic gets the same variant", "experiment", exp.Name, "keys", len(apiKeys))
+		default:
+			slog.Warn("Only one API key is configured, requests without a conversation_id all get the same variant", "experiment", exp.Name, "keys", len(apiKeys))
+		}
+		slog.Info("Loaded experiment", "experiment", exp.Name, "variants", len(exp.Variants), "traffic_percent", total, "unit", exp.Unit)
+	}
+	experiments = list
+	return nil
+}
+
+// assignExperiment returns the variant a request in the category belongs to, if any.
+func assignExperiment(category, apiKeyName, conversationID string) (*experiment, *experimentVariant) {
+	for _, exp := range experiments {
+		if !exp.categories[category] {
+			continue
+		}
+		unit := apiKeyName
+		if exp.Unit == experimentUnitConversation && conversationID != "" {
+			unit = conversationID
+		}
+		sum := sha256.Sum256([]byte(exp.Name + "/" + unit))
+		bucket := float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100 // [0, 100)
+		var cumulative float64
+		for i := range exp.Variants {
+			cumulative += exp.Variants[i].Weight
+			if bucket < cumulative {
+				return exp, &exp.Variants[i]
+			}
+		}
+		return nil, nil // Not enrolled
+	}
+	return nil, nil
+}
+
+// recordExperimentRequest adds a finished request to its variant's stats.
+func recordExperimentRequest(a experimentAssignment, duration time.Duration, costUSD float64, failed bool) {
+	experimentMu.Lock()
+	defer experimentMu.Unlock()
+	stats := experimentStatsFor(a)
+	stats.Requests++
+	if failed {
+		stats.Failed++
+	}
+	stats.TotalMS += duration.Milliseconds()
+	stats.TotalCostUSD += costUSD
+}
+
+// recordExperimentFeedback counts a rating for the variant of a decision.
+func recordExperimentFeedback(a experimentAssignment, rating string) {
+	experimentMu.Lock()
+	defer experimentMu.Unlock()
+	stats := experimentStatsFor(a)
+	if rating == feedbackRatingUp {
+		stats.FeedbackUp++
+	} else {
+		stats.FeedbackDown++
+	}
+}
+
+// experimentStatsFor must be called with experimentMu held.
+func experimentStatsFor(a experimentAssignment) *variantStats {
+	stats, ok := experimentStats[a]
+	if !ok {
+		stats = &variantStats{}
+		experimentStats[a] = stats
+	}
+	return stats
+}
+
+// experimentsHandler serves GET /api/experiments: each experiment with per-variant stats.
+func experimentsHandler(w http.ResponseWriter, r *http.Request) {
+	type variantReport struct {
+		experimentVariant
+		Stats variantStats `json:"stats"`
+	}
+	type experimentReport struct {
+		Name     string          `json:"name"`
+		Unit     string          `json:"unit"`
+		Variants []variantReport `json:"variants"`
+	}
+	reports := make([]experimentReport, 0, len(experiments))
+	experimentMu.Lock()
+	for _, exp := range experiments {
+		report := experimentReport{Name: exp.Name, Unit: exp.Unit}
+		for _, variant := range exp.Variants {
+			var stats variantStats
+			if s, ok := experimentStats[experimentAssignment{Experiment: exp.Name, Variant: variant.Name}]; ok {
+				stats = *s
+			}
+			if stats.Requests > 0 {
+				stats.AvgMS = float64(stats.TotalMS) / float64(stats.Requests)
+				stats.AvgCostUSD = stats.TotalCostUSD / float64(stats.Requests)
+			}
+			report.Variants = append(report.Variants, variantReport{experimentVariant: variant, Stats: stats})
+		}
+		reports = append(reports, report)
+	}
+	experimentMu.Unlock()
+	jsonResponse(w, map[string]interface{}{"experiments": reports})
+}
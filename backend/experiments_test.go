@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withExperiments loads the experiments JSON as EXPERIMENTS_FILE.
+func withExperiments(t *testing.T, config string) {
+	t.Helper()
+	setupTestRouter(t)
+	path := filepath.Join(t.TempDir(), "experiments.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXPERIMENTS_FILE", path)
+	previous := experiments
+	t.Cleanup(func() { experiments = previous })
+	if err := initExperiments(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssignExperimentUnits(t *testing.T) {
+	model := classificationMap["1"].Model
+	withExperiments(t, fmt.Sprintf(`[{"name":"split","variants":[
+		{"name":"a","weight":50,"routes":{"1":{"model":%q}}},
+		{"name":"b","weight":50}
+	]}]`, model))
+
+	variants := func(conversationID string) map[string]bool {
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			_, variant := assignExperiment("1", fmt.Sprintf("key-%d", i), conversationID)
+			seen[variant.Name] = true
+		}
+		return seen
+	}
+	if seen := variants("conv-1"); len(seen) != 1 {
+		t.Errorf("one conversation got variants %v from different keys, want a single one", seen)
+	}
+	if seen := variants(""); len(seen) != 2 {
+		t.Errorf("requests without a conversation got variants %v across keys, want both", seen)
+	}
+	// Without a conversation the key is the unit, so a key keeps its variant
+	_, first := assignExperiment("1", "web", "")
+	for i := 0; i < 20; i++ {
+		if _, variant := assignExperiment("1", "web", ""); variant.Name != first.Name {
+			t.Fatalf("key web got variants %s and %s", first.Name, variant.Name)
+		}
+	}
+}
+
+func TestExperimentCountsRoutingFailures(t *testing.T) {
+	handler := setupTestRouter(t)
+	if err := loadClassificationRules(); err != nil {
+		t.Fatal(err)
+	}
+	withExperiments(t, `[{"name":"no_tools","variants":[{"name":"phi","weight":100,"routes":{"8":{"model":"microsoft/phi-4"}}}]}]`)
+	previous := experimentStats
+	experimentStats = make(map[experimentAssignment]*variantStats)
+	t.Cleanup(func() { experimentStats = previous })
+
+	// The code fence rule classifies the prompt as coding, and the variant's model has no tools
+	rec := postJSON(handler, "/api/chat", `{"model":"auto","messages":[{"role":"user","content":"`+"```go\\nfmt.Println()\\n```"+`"}],
+		"tools":[{"type":"function","function":{"name":"run","parameters":{}}}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	stats := experimentStats[experimentAssignment{Experiment: "no_tools", Variant: "phi"}]
+	if stats == nil || stats.Requests != 1 || stats.Failed != 1 {
+		t.Errorf("variant stats = %+v, want 1 failed request", stats)
+	}
+}
+
+func TestInitExperimentsWarnsOnSingleAPIKey(t *testing.T) {
+	logs := captureLogs(t)
+	withExperiments(t, fmt.Sprintf(`[{"name":"by_key","unit":"api_key","variants":[{"name":"a","weight":50,"routes":{"1":{"model":%q}}}]}]`, classificationMap["1"].Model))
+	if !strings.Contains(logs.String(), "only one key is configured") {
+		t.Errorf("no warning about a single API key in logs:\n%s", logs)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routingDecision is what the router decided for one chat request, kept so user feedback
+// can be stored next to it. Only the API key that made the request can rate it.
+type routingDecision struct {
+	RequestID            string                `json:"request_id"`
+	APIKey               string                `json:"api_key"` // Key name
+	Timestamp            time.Time             `json:"timestamp"`
+	RequestedModel       string                `json:"requested_model"`
+	Category             string                `json:"category,omitempty"`
+	CategoryName         string                `json:"category_name,omitempty"`
+	ClassificationSource string                `json:"classification_source,omitempty"`
+	Model                string                `json:"model"`
+	Experiment           *experimentAssignment `json:"experiment,omitempty"`
+	Prompt               string                `json:"prompt,omitempty"`      // Only kept with LOG_CONTENT=full (see storedContent)
+	PromptHash           string                `json:"prompt_hash,omitempty"` // Keyed hash, unless LOG_CONTENT=none
+}
+
+// feedbackRequest is the body of POST /api/feedback.
+type feedbackRequest struct {
+	RequestID        string `json:"request_id"`
+	Rating           string `json:"rating"`                      // "up" or "down"
+	ExpectedCategory string `json:"expected_category,omitempty"` // Category key or name the router should have picked
+	Comment          string `json:"comment,omitempty"`
+}
+
+// feedbackRecord is one line of the feedback file.
+type feedbackRecord struct {
+	ReceivedAt       time.Time       `json:"received_at"`
+	Rating           string          `json:"rating"`
+	ExpectedCategory string          `json:"expected_category,omitempty"`
+	Comment          string          `json:"comment,omitempty"`
+	Decision         routingDecision `json:"decision"`
+}
+
+const (
+	feedbackRatingUp   = "up"
+	feedbackRatingDown = "down"
+	maxFeedbackComment = 4000
+)
+
+// decisionBuffer keeps the most recent routing decisions in memory, oldest evicted first.
+type decisionBuffer struct {
+	mu        sync.Mutex
+	capacity  int
+	retention time.Duration
+	order     []decisionKey
+	decisions map[decisionKey]routingDecision
+}
+
+var (
+	recentDecisions = &decisionBuffer{capacity: 10000, retention: 24 * time.Hour, decisions: make(map[decisionKey]routingDecision)}
+	feedbackPath    = "feedback.jsonl"
+	feedbackMu      sync.Mutex
+)
+
+// initFeedback configures feedback storage from FEEDBACK_FILE, FEEDBACK_DECISION_BUFFER
+// (number of recent decisions feedback can refer to) and FEEDBACK_DECISION_RETENTION.
+// Decisions are only kept in memory, so requests made before a restart can no longer be rated
+// and each replica only accepts feedback on the requests it served. Prompts are only recorded
+// with LOG_CONTENT=full, and feedback-export needs them to build a dataset.
+func initFeedback() {
+	feedbackPath = envString("FEEDBACK_FILE", feedbackPath)
+	recentDecisions.capacity = envInt("FEEDBACK_DECISION_BUFFER", recentDecisions.capacity)
+	recentDecisions.retention = envDuration("FEEDBACK_DECISION_RETENTION", recentDecisions.retention)
+	slog.Info("Recording routing feedback", "path", feedbackPath, "decisions", recentDecisions.capacity, "retention", recentDecisions.retention.String())
+	if contentLogSettings.Mode != logContentFull {
+		slog.Warn("Feedback is recorded without prompts and can't be exported as an eval dataset, set LOG_CONTENT=full to keep them", "log_content", contentLogSettings.Mode)
+	}
+}
+
+// decisionKey identifies a decision by the API key and request ID together. Request IDs may come
+// from the client's X-Request-ID, so two keys can use the same one without clashing.
+type decisionKey struct {
+	apiKey    string
+	requestID string
+}
+
+// Add stores a decision, evicting the oldest ones beyond capacity.
+func (b *decisionBuffer) Add(decision routingDecision) {
+	if b.capacity <= 0 {
+		return
+	}
+	id := decisionKey{decision.APIKey, decision.RequestID}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.decisions[id]; !exists {
+		b.order = append(b.order, id)
+	}
+	b.decisions[id] = decision
+	for len(b.order) > b.capacity {
+		delete(b.decisions, b.order[0])
+		b.order = b.order[1:]
+	}
+}
+
+// Get returns the decision for a request ID made with the named API key if it is still retained.
+func (b *decisionBuffer) Get(apiKeyName, requestID string) (routingDecision, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	decision, ok := b.decisions[decisionKey{apiKeyName, requestID}]
+	if !ok || time.Since(decision.Timestamp) > b.retention {
+		return routingDecision{}, false
+	}
+	return decision, true
+}
+
+// appendFeedback appends a record to the feedback file.
+func appendFeedback(record feedbackRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	feedbackMu.Lock()
+	defer feedbackMu.Unlock()
+	f, err := os.OpenFile(feedbackPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// feedbackHandler accepts thumbs up/down feedback on a previous chat request.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	var req feedbackRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	req.Rating = strings.ToLower(strings.TrimSpace(req.Rating))
+	if req.Rating != feedbackRatingUp && req.Rating != feedbackRatingDown {
+		http.Error(w, "Bad Request: 'rating' must be \"up\" or \"down\"", http.StatusBadRequest)
+		return
+	}
+	if req.ExpectedCategory != "" {
+		category, ok := resolveCategory(req.ExpectedCategory)
+		if !ok {
+			http.Error(w, "Bad Request: Unknown 'expected_category'", http.StatusBadRequest)
+			return
+		}
+		req.ExpectedCategory = category
+	}
+	if len(req.Comment) > maxFeedbackComment {
+		http.Error(w, "Bad Request: 'comment' is too long", http.StatusBadRequest)
+		return
+	}
+
+	// Another key's request is reported as unknown, so request IDs can't be probed
+	var keyName string
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		keyName = key.Name
+	}
+	decision, ok := recentDecisions.Get(keyName, req.RequestID)
+	if !ok {
+		http.Error(w, "Not Found: Unknown or expired 'request_id'", http.StatusNotFound)
+		return
+	}
+
+	record := feedbackRecord{
+		ReceivedAt:       time.Now().UTC(),
+		Rating:           req.Rating,
+		ExpectedCategory: req.ExpectedCategory,
+		Comment:          req.Comment,
+		Decision:         decision,
+	}
+	if err := appendFeedback(record); err != nil {
+		logFor(r.Context()).Error("Failed to store feedback", "rated_request_id", req.RequestID, "error", err)
+		http.Error(w, "Internal Server Error: Failed to store feedback", http.StatusInternalServerError)
+		return
+	}
+	logFor(r.Context()).Info("Recorded feedback", "rated_request_id", req.RequestID, "rating", req.Rating, "category", decision.Category, "expected_category", req.ExpectedCategory)
+	if decision.Experiment != nil {
+		recordExperimentFeedback(*decision.Experiment, req.Rating)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "recorded", "request_id": req.RequestID})
+}
+
+// runFeedbackExportCommand implements the "feedback-export" subcommand, turning the feedback
+// file into an evaluation dataset for the "eval" subcommand, and returns the exit code. Only
+// feedback recorded with LOG_CONTENT=full has prompts; the rest is skipped, and the export fails
+// if that leaves nothing to export.
+//
+//	backend feedback-export [-in feedback.jsonl] [-out dataset.jsonl] [-include-positive=true]
+func runFeedbackExportCommand(args []string) int {
+	fs := flag.NewFlagSet("feedback-export", flag.ContinueOnError)
+	inPath := fs.String("in", envString("FEEDBACK_FILE", feedbackPath), "Feedback file written by POST /api/feedback")
+	outPath := fs.String("out", "", "Output dataset path (default stdout)")
+	includePositive := fs.Bool("include-positive", true, "Label thumbs-up requests with the category the router chose")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	in, err := os.Open(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "feedback-export: %v\n", err)
+		return 1
+	}
+	defer in.Close()
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "feedback-export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	exported, skipped, err := exportFeedbackDataset(in, out, *includePositive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "feedback-export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d examples (%d feedback records skipped).\n", exported, skipped)
+	return 0
+}
+
+// errFeedbackWithoutPrompts means no labelled feedback record has a prompt to export.
+var errFeedbackWithoutPrompts = errors.New("no feedback record has a prompt, record feedback with LOG_CONTENT=full to export it")
+
+// exportFeedbackDataset converts feedback records into evalExample lines. The latest feedback
+// for a request wins. Thumbs-down feedback without an expected category carries no label and is
+// skipped, as is feedback without a prompt; errFeedbackWithoutPrompts is returned when the latter
+// leaves nothing exported.
+func exportFeedbackDataset(in io.Reader, out io.Writer, includePositive bool) (int, int, error) {
+	var order []string
+	latest := make(map[string]feedbackRecord)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	lineNo, records := 0, 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		records++
+		var record feedbackRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return 0, 0, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		id := record.Decision.RequestID
+		if _, seen := latest[id]; !seen {
+			order = append(order, id)
+		}
+		latest[id] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	enc := json.NewEncoder(out)
+	exported, skipped, withoutPrompt := 0, records-len(order), 0 // Superseded feedback counts as skipped
+	for _, id := range order {
+		record := latest[id]
+		example := evalExample{Prompt: record.Decision.Prompt}
+		switch {
+		case record.ExpectedCategory != "":
+			example.Category = record.ExpectedCategory
+		case record.Rating == feedbackRatingUp && includePositive && record.Decision.Category != "":
+			example.Category = record.Decision.Category
+		}
+		if example.Category == "" {
+			skipped++
+			continue
+		}
+		if strings.TrimSpace(example.Prompt) == "" {
+			skipped++
+			withoutPrompt++
+			continue
+		}
+		if err := enc.Encode(example); err != nil {
+			return exported, skipped, err
+		}
+		exported++
+	}
+	if exported == 0 && withoutPrompt > 0 {
+		return 0, skipped, errFeedbackWithoutPrompts
+	}
+	return exported, skipped, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedbackOnlyFromTheRequestingKey(t *testing.T) {
+	previousPath, previousDecisions := feedbackPath, recentDecisions
+	t.Cleanup(func() { feedbackPath, recentDecisions = previousPath, previousDecisions })
+	feedbackPath = filepath.Join(t.TempDir(), "feedback.jsonl")
+	recentDecisions = &decisionBuffer{capacity: 10, retention: time.Hour, decisions: make(map[decisionKey]routingDecision)}
+	recentDecisions.Add(routingDecision{RequestID: "req-1", APIKey: "web", Timestamp: time.Now(), Category: "1", Model: "m"})
+	// Another key reusing the ID doesn't replace the first key's decision
+	recentDecisions.Add(routingDecision{RequestID: "req-1", APIKey: "batch", Timestamp: time.Now(), Category: "2", Model: "m"})
+
+	tests := []struct {
+		name     string
+		key      *apiKey
+		id       string
+		wantCode int
+	}{
+		{"other key", &apiKey{Name: "ops"}, "req-1", http.StatusNotFound},
+		{"unknown request", &apiKey{Name: "web"}, "req-2", http.StatusNotFound},
+		{"requesting key", &apiKey{Name: "web"}, "req-1", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/feedback", strings.NewReader(`{"request_id":"`+tt.id+`","rating":"up"}`))
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, tt.key))
+			rec := httptest.NewRecorder()
+			feedbackHandler(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(feedbackPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), `"category":"1"`) {
+		t.Errorf("feedback file = %s, want one record on the web key's decision", data)
+	}
+}
+
+func TestExportFeedbackDatasetNeedsPrompts(t *testing.T) {
+	tests := []struct {
+		name         string
+		records      string
+		wantExported int
+		wantErr      bool
+	}{
+		{"with prompts", `{"rating":"up","decision":{"request_id":"a","category":"1","prompt":"hi"}}
+{"rating":"down","expected_category":"8","decision":{"request_id":"b","category":"1","prompt":"fix my code"}}`, 2, false},
+		{"without prompts", `{"rating":"up","decision":{"request_id":"a","category":"1","prompt_hash":"x"}}`, 0, true},
+		{"some prompts", `{"rating":"up","decision":{"request_id":"a","category":"1","prompt_hash":"x"}}
+{"rating":"up","decision":{"request_id":"b","category":"1","prompt":"hi"}}`, 1, false},
+		{"no labels", `{"rating":"down","decision":{"request_id":"a","category":"1"}}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			exported, _, err := exportFeedbackDataset(strings.NewReader(tt.records), &out, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if exported != tt.wantExported || strings.Count(out.String(), "\n") != tt.wantExported {
+				t.Errorf("exported %d examples:\n%s\nwant %d", exported, out.String(), tt.wantExported)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Health and readiness ---
+//
+// GET /healthz answers as long as the process serves HTTP. GET /readyz probes each dependency
+// (Ollama with the classification model available, and the OpenRouter API key) and returns
+// their status as JSON, with 503 if a dependency listed in READY_REQUIRED_DEPENDENCIES
+// (default "ollama,openrouter", or "none") is down. Probe results are cached for HEALTH_CACHE_TTL so
+// frequent load balancer checks don't turn into upstream traffic. The Ollama check is separate
+// from the classifier's availability state (see ollamaHealth), so readiness always reflects its
+// own probe of the classification model. Neither endpoint needs authorization.
+
+// dependencyCheck is a cached probe of one dependency.
+type dependencyCheck struct {
+	name  string
+	probe func(ctx context.Context) error
+
+	mu        sync.Mutex // Held while probing, so concurrent checks share one probe
+	lastErr   error
+	latency   time.Duration
+	checkedAt time.Time
+}
+
+// dependencyStatus is a dependency's entry in the /readyz response.
+type dependencyStatus struct {
+	Status    string    `json:"status"` // "ok" or "down"
+	Required  bool      `json:"required"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+var (
+	processStarted    = time.Now()
+	healthCacheTTL    = 10 * time.Second
+	readyRequired     = map[string]bool{}
+	dependencyChecks  []*dependencyCheck
+	openrouterKeyURL  = strings.TrimSuffix(openrouterURL, "/chat/completions") + "/key"
+	healthProbeClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// initHealth configures the readiness checks.
+func initHealth() error {
+	healthCacheTTL = envDuration("HEALTH_CACHE_TTL", healthCacheTTL)
+	dependencyChecks = []*dependencyCheck{
+		{name: "ollama", probe: probeOllama},
+		{name: "openrouter", probe: probeOpenRouterKey},
+	}
+	readyRequired = map[string]bool{}
+	for _, name := range envList("READY_REQUIRED_DEPENDENCIES", []string{"ollama", "openrouter"}) {
+		name = strings.ToLower(name)
+		if name == "none" {
+			continue
+		}
+		known := false
+		for _, check := range dependencyChecks {
+			known = known || check.name == name
+		}
+		if !known {
+			return fmt.Errorf("READY_REQUIRED_DEPENDENCIES: unknown dependency %q", name)
+		}
+		readyRequired[name] = true
+	}
+	slog.Info("Readiness checks configured", "required", sortedKeys(readyRequired), "cache_ttl", healthCacheTTL.String())
+	return nil
+}
+
+// probeOpenRouterKey checks that OpenRouter accepts the API key.
+func probeOpenRouterKey(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openrouterKeyURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENROUTER_API_KEY"))
+	resp, err := healthProbeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("OpenRouter rejected the API key (status %d)", resp.StatusCode)
+	default:
+		return fmt.Errorf("OpenRouter key endpoint returned status %d", resp.StatusCode)
+	}
+}
+
+// status returns the cached result, probing again if it is older than healthCacheTTL.
+func (c *dependencyCheck) status() dependencyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) >= healthCacheTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		c.lastErr = c.probe(ctx)
+		cancel()
+		c.latency, c.checkedAt = time.Since(start), time.Now()
+		if c.lastErr != nil {
+			slog.Warn("Readiness probe failed", "dependency", c.name, "error", c.lastErr)
+		}
+	}
+	status := dependencyStatus{Status: "ok", Required: readyRequired[c.name], LatencyMS: c.latency.Milliseconds(), CheckedAt: c.checkedAt.UTC()}
+	if c.lastErr != nil {
+		status.Status, status.Error = "down", c.lastErr.Error()
+	}
+	return status
+}
+
+// healthzHandler serves GET /healthz.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(processStarted).Seconds()),
+	})
+}
+
+// readyzHandler serves GET /readyz, probing the dependencies in parallel.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]dependencyStatus, len(dependencyChecks))
+	var wg sync.WaitGroup
+	for i, check := range dependencyChecks {
+		wg.Add(1)
+		go func(i int, check *dependencyCheck) {
+			defer wg.Done()
+			statuses[i] = check.status()
+		}(i, check)
+	}
+	wg.Wait()
+
+	ready := true
+	dependencies := make(map[string]dependencyStatus, len(statuses))
+	for i, status := range statuses {
+		dependencies[dependencyChecks[i].name] = status
+		if status.Required && status.Status != "ok" {
+			ready = false
+		}
+	}
+	response := map[string]interface{}{"status": "ready", "dependencies": dependencies}
+	if !ready {
+		response["status"] = "not_ready"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	jsonResponse(w, response)
+}
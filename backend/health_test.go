@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyzDependencies(t *testing.T) {
+	tests := []struct {
+		name        string
+		ollama      func(w http.ResponseWriter, r *http.Request)
+		keyStatus   int
+		required    string
+		wantCode    int
+		wantOllama  string
+		wantOpenRtr string
+		wantError   string
+	}{
+		{"all up", ollamaTags(classificationModel), http.StatusOK, "ollama,openrouter", http.StatusOK, "ok", "ok", ""},
+		{"tagged latest", ollamaTags(classificationModel + ":latest"), http.StatusOK, "ollama,openrouter", http.StatusOK, "ok", "ok", ""},
+		{"ollama down", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusBadGateway)
+		}, http.StatusOK, "ollama,openrouter", http.StatusServiceUnavailable, "down", "ok", "status 502"},
+		{"model missing", ollamaTags("llama3:8b"), http.StatusOK, "ollama,openrouter", http.StatusServiceUnavailable, "down", "ok", "is not available"},
+		{"key rejected", ollamaTags(classificationModel), http.StatusUnauthorized, "ollama,openrouter", http.StatusServiceUnavailable, "ok", "down", "rejected the API key"},
+		{"optional dependency down", ollamaTags("llama3:8b"), http.StatusOK, "openrouter", http.StatusOK, "down", "ok", "is not available"},
+		{"nothing required", ollamaTags("llama3:8b"), http.StatusUnauthorized, "none", http.StatusOK, "down", "down", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ollama := httptest.NewServer(http.HandlerFunc(tt.ollama))
+			defer ollama.Close()
+			openrouter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.keyStatus)
+			}))
+			defer openrouter.Close()
+
+			previousURL, previousKeyURL, previousTTL, previousHealth := ollamaURL, openrouterKeyURL, healthCacheTTL, ollamaHealth
+			previousChecks, previousRequired := dependencyChecks, readyRequired
+			t.Cleanup(func() {
+				ollamaURL, openrouterKeyURL, healthCacheTTL, ollamaHealth = previousURL, previousKeyURL, previousTTL, previousHealth
+				dependencyChecks, readyRequired = previousChecks, previousRequired
+			})
+			ollamaURL, openrouterKeyURL = ollama.URL+"/api/generate", openrouter.URL+"/api/v1/key"
+			ollamaHealth = &ollamaHealthState{healthy: true}
+			t.Setenv("READY_REQUIRED_DEPENDENCIES", tt.required)
+			if err := initHealth(); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			var body struct {
+				Status       string                      `json:"status"`
+				Dependencies map[string]dependencyStatus `json:"dependencies"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%v: %s", err, rec.Body)
+			}
+			ollamaStatus, openrouterStatus := body.Dependencies["ollama"], body.Dependencies["openrouter"]
+			if ollamaStatus.Status != tt.wantOllama || openrouterStatus.Status != tt.wantOpenRtr {
+				t.Errorf("ollama %s, openrouter %s, want %s, %s", ollamaStatus.Status, openrouterStatus.Status, tt.wantOllama, tt.wantOpenRtr)
+			}
+			if ollamaStatus.Required != strings.Contains(tt.required, "ollama") || openrouterStatus.Required != strings.Contains(tt.required, "openrouter") {
+				t.Errorf("required flags %v, %v for %q", ollamaStatus.Required, openrouterStatus.Required, tt.required)
+			}
+			if tt.wantError != "" && !strings.Contains(ollamaStatus.Error+openrouterStatus.Error, tt.wantError) {
+				t.Errorf("errors %q, %q, want %q", ollamaStatus.Error, openrouterStatus.Error, tt.wantError)
+			}
+			if healthy, _, _ := ollamaHealth.status(); !healthy {
+				t.Error("readiness probe changed the classifier's view of Ollama")
+			}
+		})
+	}
+}
+
+func TestReadyzCachesProbes(t *testing.T) {
+	probes := 0
+	check := &dependencyCheck{name: "test", probe: func(ctx context.Context) error {
+		probes++
+		return nil
+	}}
+	previousTTL := healthCacheTTL
+	t.Cleanup(func() { healthCacheTTL = previousTTL })
+	healthCacheTTL = time.Hour
+	check.status()
+	check.status()
+	if probes != 1 {
+		t.Errorf("probed %d times within the cache TTL, want 1", probes)
+	}
+}
+
+// ollamaTags answers /api/tags listing one model.
+func ollamaTags(model string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"models": []map[string]string{{"name": model}}})
+	}
+}
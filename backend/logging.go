@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// --- Structured logging ---
+//
+// Logs are written with log/slog as JSON lines (LOG_FORMAT=text for key=value lines) at LOG_LEVEL
+// (debug, info, warn or error; default info). Each request has an ID, taken from the client's
+// X-Request-ID header or generated, which is returned in the X-Request-ID response header (and
+// the chat metadata event) and attached to the request's log lines through its context.
+// Every line passes through redactingHandler (see redaction.go).
+
+const requestIDHeader = "X-Request-ID"
+
+var logLevel = new(slog.LevelVar)
+
+type requestIDContextKey struct{}
+
+// initLogging installs the structured logger as the default for slog and the log package.
+func initLogging() error {
+	switch level := strings.ToLower(envString("LOG_LEVEL", "info")); level {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "warn", "warning":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		return fmt.Errorf("invalid LOG_LEVEL %q, expected debug, info, warn or error", level)
+	}
+	if err := initContentLogging(); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format := strings.ToLower(envString("LOG_FORMAT", "json")); format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(redactingHandler{inner: handler}))
+	return nil
+}
+
+// fatal logs an error that prevents the server from running and exits.
+func fatal(err error) {
+	slog.Error("FATAL", "error", err)
+	os.Exit(1)
+}
+
+// requestIDFor returns the request's X-Request-ID if it is a usable identifier (up to 128 letters,
+// digits and "-_.:"), or a new random ID.
+func requestIDFor(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		return randomID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return randomID()
+		}
+	}
+	return id
+}
+
+// requestIDMiddleware assigns each request its ID, returns it in the response headers and attaches
+// it to the request context for logFor and requestIDFromContext.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFor(r)
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), requestID)))
+	})
+}
+
+// requestIDFromContext returns the request ID attached by requestIDMiddleware or withRequestID.
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// withRequestID attaches a request ID to a context, including ones for background work that
+// outlives the request.
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// logFor returns the default logger with the context's request ID and trace ID, if any.
+func logFor(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	if sc, ok := traceFromContext(ctx); ok {
+		logger = logger.With("trace_id", hex.EncodeToString(sc.traceID[:]))
+	}
+	return logger
+}
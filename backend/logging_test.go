@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{"generated", "", false},
+		{"client ID kept", "abc-123_x.y:z", true},
+		{"invalid characters replaced", "abc 123<script>", false},
+		{"too long replaced", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = requestIDFromContext(r.Context())
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			requestIDMiddleware(next).ServeHTTP(rec, req)
+
+			got := rec.Header().Get(requestIDHeader)
+			if got == "" || got != fromContext {
+				t.Fatalf("response ID %q, context ID %q", got, fromContext)
+			}
+			if (got == tt.incoming) != tt.wantSame {
+				t.Errorf("ID = %q for incoming %q", got, tt.incoming)
+			}
+		})
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,12 +23,15 @@ const (
 	listenAddr          = ":42069"
 	authHeaderKey       = "Authorization"
 	authHeaderValue     = "ljubimte" // Development value
-	ollamaURL           = "http://localhost:11434/api/generate"
-	openrouterURL       = "https://openrouter.ai/api/v1/chat/completions"
-	classificationModel = "gemma3:4b" // Using gemma3:4b for classification
 	autoModelIdentifier = "auto"
 )
 
+var (
+	openrouterURL       = "https://openrouter.ai/api/v1/chat/completions" // A variable so tests can use a stub
+	ollamaURL           = envString("OLLAMA_URL", "http://localhost:11434/api/generate")
+	classificationModel = envString("CLASSIFICATION_MODEL", "gemma3:4b") // Using gemma3:4b for classification by default
+)
+
 const (
 	ContextMaxChars = 4000 * 3
 ) // Assuming average 3 chars per token for context window estimation
@@ -31,48 +39,58 @@ const (
 // classificationMap defines the different model capabilities the backend can handle.
 var classificationMap = map[string]struct {
 	Name             string
-	Model            string // OpenRouter model for generation
-	AdditionalPrompt string // New field for prepending to user prompt
+	Model            string   // OpenRouter model for generation
+	Candidates       []string // Alternatives, in order, for requests Model can't serve (see routing.go)
+	AdditionalPrompt string   // New field for prepending to user prompt
 }{
 	"1": {
-		Name:  "Research & Knowledge",
-		Model: "google/gemini-2.5-flash-preview", // Perplexity models excel at research and knowledge tasks
+		Name:       "Research & Knowledge",
+		Model:      "google/gemini-2.5-flash-preview", // Perplexity models excel at research and knowledge tasks
+		Candidates: []string{"openai/gpt-4.1-mini"},
 	},
 	"2": {
-		Name:  "Real-time web-necessary Research & Knowledge",
-		Model: "google/gemini-2.5-flash-preview:online", // Perplexity models excel at research and knowledge tasks
+		Name:       "Real-time web-necessary Research & Knowledge",
+		Model:      "google/gemini-2.5-flash-preview:online", // Perplexity models excel at research and knowledge tasks
+		Candidates: []string{"openai/gpt-4.1-mini:online"},
 	},
 	"3": {
-		Name:  "Complex Problem Solving & Strategy",
-		Model: "anthropic/claude-sonnet-4", // Excels at complex reasoning, problem-solving
+		Name:       "Complex Problem Solving & Strategy",
+		Model:      "anthropic/claude-sonnet-4", // Excels at complex reasoning, problem-solving
+		Candidates: []string{"openai/o4-mini", "google/gemini-2.5-pro-preview"},
 	},
 	"4": {
-		Name:  "Writing & Communication",
-		Model: "x-ai/grok-3-mini-beta", // Strong model for writing assistance and clear communication
+		Name:       "Writing & Communication",
+		Model:      "x-ai/grok-3-mini-beta", // Strong model for writing assistance and clear communication
+		Candidates: []string{"openai/gpt-4.1-mini", "google/gemini-2.5-flash-preview"},
 	},
 	"5": {
 		Name:  "Explanation & Instruction",
 		Model: "google/gemini-2.5-flash-preview", // Efficient and capable model for explanations
 	},
 	"6": {
-		Name:  "Content Generation",
-		Model: "anthropic/claude-3.7-sonnet:thinking", // Good for structured data and content generation
+		Name:       "Content Generation",
+		Model:      "anthropic/claude-3.7-sonnet:thinking", // Good for structured data and content generation
+		Candidates: []string{"openai/gpt-4.1", "google/gemini-2.5-pro-preview"},
 	},
 	"7": {
-		Name:  "Emotional Intelligence & Support",
-		Model: "google/gemini-2.5-flash-preview", // Empathetic and conversational model
+		Name:       "Emotional Intelligence & Support",
+		Model:      "google/gemini-2.5-flash-preview", // Empathetic and conversational model
+		Candidates: []string{"openai/gpt-4o-mini"},
 	},
 	"8": {
-		Name:  "Coding & Technical Tasks",
-		Model: "anthropic/claude-sonnet-4", // Top-tier model for coding, reasoning, summarization
+		Name:       "Coding & Technical Tasks",
+		Model:      "anthropic/claude-sonnet-4", // Top-tier model for coding, reasoning, summarization
+		Candidates: []string{"openai/gpt-4.1", "google/gemini-2.5-pro-preview"},
 	},
 	"9": {
-		Name:  "Creative & Artistic",
-		Model: "openai/gpt-4.5-preview", // Strong creative and instruction-following model
+		Name:       "Creative & Artistic",
+		Model:      "openai/gpt-4.5-preview", // Strong creative and instruction-following model
+		Candidates: []string{"google/gemini-2.5-pro-preview"},
 	},
 	"10": {
 		Name:             "Small chit chat",
 		Model:            "meta-llama/llama-4-scout",
+		Candidates:       []string{"openai/gpt-4.1-nano", "google/gemini-2.0-flash-001"},
 		AdditionalPrompt: "Maybe use emoji. Maybe not! just be yourself. User message: ",
 	},
 }
@@ -82,6 +100,95 @@ var classificationMap = map[string]struct {
 type chatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+
+	// Parts holds the content array of multimodal messages, passed through unchanged; Content then
+	// holds the text parts. ToolCalls and ToolCallID carry OpenAI-style tool use.
+	Parts      []json.RawMessage `json:"-"`
+	ToolCalls  json.RawMessage   `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+// contentPart is the part of a multimodal content entry we inspect.
+type contentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+// UnmarshalJSON accepts content as a string, null (tool calls) or an array of content parts.
+func (m *chatMessage) UnmarshalJSON(data []byte) error {
+	type plain chatMessage
+	var aux struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*m = chatMessage(aux.plain)
+	raw := bytes.TrimSpace(aux.Content)
+	switch {
+	case len(raw) == 0 || bytes.Equal(raw, []byte("null")):
+	case raw[0] == '[':
+		if err := json.Unmarshal(raw, &m.Parts); err != nil {
+			return fmt.Errorf("invalid message content: %w", err)
+		}
+		var texts []string
+		for _, rawPart := range m.Parts {
+			var part contentPart
+			if err := json.Unmarshal(rawPart, &part); err != nil {
+				return fmt.Errorf("invalid message content part: %w", err)
+			}
+			if part.Type == "text" {
+				texts = append(texts, part.Text)
+			}
+		}
+		m.Content = strings.Join(texts, "\n")
+	default:
+		if err := json.Unmarshal(raw, &m.Content); err != nil {
+			return fmt.Errorf("invalid message content: %w", err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes Parts as the content array for multimodal messages.
+func (m chatMessage) MarshalJSON() ([]byte, error) {
+	type plain chatMessage
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []json.RawMessage `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// partTypes returns the content part types of a multimodal message.
+func (m chatMessage) partTypes() []string {
+	types := make([]string, 0, len(m.Parts))
+	for _, rawPart := range m.Parts {
+		var part contentPart
+		if json.Unmarshal(rawPart, &part) == nil {
+			types = append(types, part.Type)
+		}
+	}
+	return types
+}
+
+// prependText adds text before the message content, as a leading text part for multimodal messages.
+func (m *chatMessage) prependText(text string) {
+	m.Content = text + "\n" + m.Content
+	if len(m.Parts) > 0 {
+		m.Parts = append([]json.RawMessage{mustJSON(contentPart{Type: "text", Text: text})}, m.Parts...)
+	}
+}
+
+// providerOptions are OpenAI-compatible request fields passed through to OpenRouter unchanged.
+type providerOptions struct {
+	Tools          json.RawMessage `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage `json:"tool_choice,omitempty"`
+	ResponseFormat json.RawMessage `json:"response_format,omitempty"`
+	Usage          json.RawMessage `json:"usage,omitempty"` // {"include": true} adds a usage block to the last chunk
 }
 
 // completionRequest structure adaptable for both Ollama and OpenRouter
@@ -90,6 +197,10 @@ type completionRequest struct {
 	Prompt   string        `json:"prompt,omitempty"`   // Used by Ollama
 	Messages []chatMessage `json:"messages,omitempty"` // Used by OpenRouter Chat API
 	Stream   bool          `json:"stream"`
+	providerOptions
+
+	ConversationID string          `json:"conversation_id,omitempty"` // Only sent by our clients: continue a stored conversation
+	Routing        *routingOptions `json:"routing,omitempty"`         // Only sent by our clients: auto mode preferences
 }
 
 // ollamaResponse structure for non-streaming responses
@@ -139,108 +250,249 @@ type ServerSentEvent struct {
 // --- Main Application Logic ---
 
 func main() {
-	// Ensure OpenRouter API key is set
-	if os.Getenv("OPENROUTER_API_KEY") == "" {
-		log.Fatal("FATAL: OPENROUTER_API_KEY environment variable is not set")
+	// Offline subcommands don't need the server configuration
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			os.Exit(runEvalCommand(os.Args[2:]))
+		case "feedback-export":
+			os.Exit(runFeedbackExportCommand(os.Args[2:]))
+		case "audit-export":
+			os.Exit(runAuditExportCommand(os.Args[2:]))
+		}
 	}
 
-	// Set up HTTP handler
-	http.HandleFunc("/api/chat", handler)
-	log.Printf("Server starting on %s...", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
-}
-
-// handler is the main HTTP request handler
-func handler(w http.ResponseWriter, r *http.Request) {
-	// CORS Headers - Allow all origins
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept")
+	if err := initLogging(); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
 
-	// Handle preflight OPTIONS requests
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
+	// Ensure OpenRouter API key is set
+	if os.Getenv("OPENROUTER_API_KEY") == "" {
+		fatal(errors.New("OPENROUTER_API_KEY environment variable is not set"))
 	}
 
-	// 1. Validate Request Method (ensure it's POST after handling OPTIONS)
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed: Only POST requests are accepted", http.StatusMethodNotAllowed)
-		return
+	// Load the rule-based pre-classifier
+	if err := loadClassificationRules(); err != nil {
+		fatal(err)
+	}
+	initClassificationCache()
+	if err := initClassifierFallback(); err != nil {
+		fatal(err)
+	}
+	initFeedback()
+	if err := initConversationStore(); err != nil {
+		fatal(err)
+	}
+	if err := initAPIKeys(); err != nil {
+		fatal(err)
+	}
+	if err := initModelRegistry(); err != nil {
+		fatal(err)
+	}
+	if err := initTokenizers(); err != nil {
+		fatal(err)
+	}
+	if err := initContextManagement(); err != nil {
+		fatal(err)
+	}
+	if err := initRouting(); err != nil {
+		fatal(err)
+	}
+	if err := initExperiments(); err != nil {
+		fatal(err)
+	}
+	if err := initShadow(); err != nil {
+		fatal(err)
+	}
+	if err := initCompare(); err != nil {
+		fatal(err)
+	}
+	if err := initTracing(); err != nil {
+		fatal(err)
+	}
+	if err := initAudit(); err != nil {
+		fatal(err)
+	}
+	if err := initHealth(); err != nil {
+		fatal(err)
+	}
+	if err := initCORS(); err != nil {
+		fatal(err)
+	}
+	if err := initRateLimits(); err != nil {
+		fatal(err)
 	}
 
-	// 2. Validate Authorization
-	if r.Header.Get(authHeaderKey) != authHeaderValue {
-		http.Error(w, "Forbidden: Invalid or missing authorization token", http.StatusForbidden)
-		return
+	server, err := newServer(newRouter(routes))
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("Server starting", "addr", listenAddr)
+	if err := serveUntilSignal(server, func() error { return listenAndServe(server) }); err != nil {
+		fatal(err)
 	}
+}
+
+// chatHandler serves POST /api/chat. The method, API key and rate limit are checked by the
+// route's middleware (see router.go).
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	// Every log line about this request carries its ID, which is also returned to the client
+	ctx := r.Context()
+	requestID, key := requestIDFromContext(ctx), apiKeyFromContext(ctx)
+	logger := logFor(ctx)
+	started := time.Now()
 
-	// 3. Decode Request Body (New OpenRouter-like format)
+	// 1. Decode Request Body (New OpenRouter-like format)
 	var requestBody completionRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-		http.Error(w, "Bad Request: Could not decode JSON payload: "+err.Error(), http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &requestBody) {
 		return
 	}
 
-	// 4. Validate Messages
+	// 2. Validate Messages
 	if len(requestBody.Messages) == 0 {
 		http.Error(w, "Bad Request: 'messages' field cannot be empty", http.StatusBadRequest)
 		return
 	}
+	var routingOpts routingOptions
+	if requestBody.Routing != nil {
+		routingOpts = *requestBody.Routing
+		routingOpts.Preference = strings.ToLower(routingOpts.Preference)
+		if err := routingOpts.validate(); err != nil {
+			http.Error(w, "Bad Request: Invalid 'routing': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 3. Load stored history when continuing a conversation; Messages then only holds the new turn(s)
+	newTurns := append([]chatMessage(nil), requestBody.Messages...) // Stored before AdditionalPrompt is applied
+	if requestBody.ConversationID != "" {
+		if conversations == nil {
+			http.Error(w, "Bad Request: Conversation storage is disabled", http.StatusBadRequest)
+			return
+		}
+		conv, err := conversations.GetConversation(ctx, conversationOwner(ctx), requestBody.ConversationID)
+		if errors.Is(err, errConversationNotFound) {
+			http.Error(w, "Not Found: Unknown 'conversation_id'", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to load conversation", "conversation_id", requestBody.ConversationID, "error", err)
+			http.Error(w, "Internal Server Error: Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		requestBody.Messages = append(toChatMessages(conv.Messages), requestBody.Messages...)
+		logger.Info("Continuing conversation", "conversation_id", conv.ID, "stored_messages", len(conv.Messages))
+	}
 
 	userInput, err := extractUserPrompt(requestBody.Messages)
 	if err != nil {
 		// If no user prompt is found, but messages are present, it's unusual but proceed.
 		// Classification might fail or OpenRouter might handle it.
 		// For classification, an empty userInput will be sent.
-		log.Printf("WARN: Could not extract user prompt: %v. Proceeding with empty prompt for classification if 'auto'.", err)
+		logger.Warn("Could not extract user prompt, proceeding with empty prompt for classification if 'auto'", "error", err)
 		userInput = "" // Ensure userInput is empty for classification if extraction failed
 	}
 	// Log the full messages array for debugging if needed, be mindful of log size.
-	log.Printf("Received request for model '%s', stream: %t.", requestBody.Model, requestBody.Stream)
+	logger.Info("Received request", "model", requestBody.Model, "stream", requestBody.Stream, "api_key", key.Name, contentAttr("prompt", userInput))
 
 	chosenModel := requestBody.Model
 	var classificationNumber string
 	var classificationNameForMetadata string
 	var modelSelectedByClassification string
+	var outcome classificationOutcome
+	var routing *routeExplanation
+	var assignment *experimentAssignment
+	var contextReport contextTrimReport
+	var assistantReply string // Persisted when continuing a stored conversation
+	var requestErr error      // Why the request failed after routing started, for experiment stats
 	classificationPerformed := false
 
 	if strings.ToLower(chosenModel) == autoModelIdentifier {
 		classificationPerformed = true
 		var classErr error
-		classificationNumber, classErr = classifyPrompt(userInput)
+		// Rules, cache and Ollama, degrading to the configured fallbacks if Ollama is down.
+		outcome, classErr = classifyRequest(ctx, userInput)
 		if classErr != nil {
-			log.Printf("ERROR: Classification failed: %v", classErr)
+			logger.Error("Classification failed", "error", classErr)
+			status, message := http.StatusInternalServerError, "Internal Server Error: Failed during prompt classification"
+			if errors.Is(classErr, errInvalidClassification) {
+				status, message = http.StatusBadRequest, "Bad Request: Invalid classification result"
+			}
 			// If streaming, send error in stream, otherwise HTTP error
 			if requestBody.Stream {
 				setupSSEHeaders(w)
-				w.WriteHeader(http.StatusInternalServerError) // Set status before writing body
-				sendErrorSSE(w, "Internal Server Error: Failed during prompt classification")
-				sendDoneSSE(w) // Signal end of problematic stream
+				w.WriteHeader(status) // Set status before writing body
+				sendErrorSSE(ctx, w, message)
+				sendDoneSSE(ctx, w) // Signal end of problematic stream
 			} else {
-				http.Error(w, "Internal Server Error: Failed during prompt classification", http.StatusInternalServerError)
+				http.Error(w, message, status)
 			}
 			return
 		}
-		log.Printf("Classified as: %s", classificationNumber)
+		classificationNumber = outcome.Category
+		logger.Info("Classified prompt", "category", classificationNumber, "source", outcome.Source)
 
 		classificationInfo, ok := classificationMap[classificationNumber]
 		if !ok {
-			log.Printf("ERROR: Invalid classification number received: %s", classificationNumber)
+			logger.Error("Invalid classification number received", "category", classificationNumber)
 			if requestBody.Stream {
 				setupSSEHeaders(w)
 				w.WriteHeader(http.StatusBadRequest)
-				sendErrorSSE(w, "Bad Request: Invalid classification result")
-				sendDoneSSE(w)
+				sendErrorSSE(ctx, w, "Bad Request: Invalid classification result")
+				sendDoneSSE(ctx, w)
 			} else {
 				http.Error(w, "Bad Request: Invalid classification result", http.StatusBadRequest)
 			}
 			return
 		}
-		chosenModel = classificationInfo.Model
+		// Experiments may replace the category's route for part of the traffic
+		route := categoryRoute{Model: classificationInfo.Model, Candidates: classificationInfo.Candidates}
+		if exp, variant := assignExperiment(classificationNumber, key.Name, requestBody.ConversationID); variant != nil {
+			assignment = &experimentAssignment{Experiment: exp.Name, Variant: variant.Name}
+			if override, ok := variant.Routes[classificationNumber]; ok {
+				route = override
+			}
+			logger.Info("Assigned experiment variant", "experiment", exp.Name, "variant", variant.Name, "category", classificationNumber, "model", route.Model)
+			// Registered before routing, so a variant's routing failures count against it
+			defer func() {
+				completionTokens, _ := countTextTokens(chosenModel, assistantReply)
+				cost, _ := estimateCostUSD(chosenModel, contextReport.TokensAfter, completionTokens)
+				recordExperimentRequest(*assignment, time.Since(started), cost, requestErr != nil)
+			}()
+		}
+		chosenModel = route.Model
 		classificationNameForMetadata = classificationNumber + "-" + classificationInfo.Name
-		modelSelectedByClassification = classificationInfo.Model
-		log.Printf("Mapped to: %s (Model: %s)", classificationNameForMetadata, chosenModel)
+		modelSelectedByClassification = route.Model
+
+		// Pick the first of the category's models that supports what the request needs
+		if classificationNumber != "5" {
+			requirements := requirementsFor(requestBody)
+			requirements.Key = key
+			explanation, err := routeCategory(ctx, classificationNumber, route, requirements, routingOpts)
+			if err != nil {
+				requestErr = err
+				logger.Error("Routing failed", "error", err)
+				status, message := http.StatusBadRequest, "Bad Request: No model for category '"+classificationInfo.Name+"' supports "+strings.Join(explanation.Required, ", ")
+				switch {
+				case errors.Is(err, errNoAffordableModel):
+					message = "Bad Request: No model for category '" + classificationInfo.Name + "' fits 'max_cost_per_request'"
+				case errors.Is(err, errNoPermittedModel):
+					status, message = http.StatusForbidden, "Forbidden: This API key may not use any model for category '"+classificationInfo.Name+"'"
+				}
+				if requestBody.Stream {
+					setupSSEHeaders(w)
+					w.WriteHeader(status)
+					sendErrorSSE(ctx, w, message)
+					sendDoneSSE(ctx, w)
+				} else {
+					http.Error(w, message, status)
+				}
+				return
+			}
+			chosenModel = explanation.Selected
+			routing = &explanation
+		}
+		logger.Info("Mapped category to model", "classification", classificationNameForMetadata, "model", chosenModel)
 
 		// Prepend AdditionalPrompt if it exists for the classification
 		if classificationInfo.AdditionalPrompt != "" {
@@ -252,34 +504,116 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			for i := len(requestBody.Messages) - 1; i >= 0; i-- {
 				if requestBody.Messages[i].Role == "user" {
 					// Prepend the additional prompt to the existing content of the last user message
-					requestBody.Messages[i].Content = classificationInfo.AdditionalPrompt + "\n" + requestBody.Messages[i].Content
-					log.Printf("INFO: Prepended additional prompt to user message for classification %s: '%s'", classificationNumber, classificationInfo.AdditionalPrompt)
+					requestBody.Messages[i].prependText(classificationInfo.AdditionalPrompt)
+					logger.Info("Prepended additional prompt to user message", "category", classificationNumber, "additional_prompt", classificationInfo.AdditionalPrompt)
 					modifiedMessages = true
 					break // Modify only the last user message
 				}
 			}
 			if !modifiedMessages {
-				log.Printf("WARN: AdditionalPrompt was present for classification %s, but no user message was found in the request to prepend it to.", classificationNumber)
+				logger.Warn("AdditionalPrompt was present, but no user message was found in the request to prepend it to", "category", classificationNumber)
 			}
 		}
 
 	} else {
-		// Direct model specified
+		// Direct model specified; it must be known to the model registry
+		if err := models.Validate(chosenModel); err != nil {
+			logger.Warn("Rejected direct model request", "error", err)
+			http.Error(w, "Bad Request: Unknown model '"+chosenModel+"'. See GET /api/models for available models.", http.StatusBadRequest)
+			return
+		}
+		if !key.modelAllowed(chosenModel) {
+			logger.Warn("Rejected direct model request: not permitted", "model", chosenModel, "api_key", key.Name)
+			writeModelForbidden(w, key, chosenModel)
+			return
+		}
 		classificationNameForMetadata = "direct_request_classification_skipped"
 		modelSelectedByClassification = chosenModel
-		log.Printf("Direct model specified: %s, classification skipped.", chosenModel)
+		logger.Info("Direct model specified, classification skipped", "model", chosenModel)
+	}
+
+	setMetricLabels(w, chosenModel, classificationNumber)
+	audit := auditEntry(w)
+	audit.RequestedModel, audit.Stream = requestBody.Model, requestBody.Stream
+	requestSpan := spanFromContext(ctx)
+	requestSpan.setAttribute("llm.model", chosenModel)
+	requestSpan.setAttribute("llm.stream", requestBody.Stream)
+	if classificationPerformed {
+		requestSpan.setAttribute("llm.category", classificationNumber)
+		requestSpan.setAttribute("llm.classification_source", outcome.Source)
+	}
+
+	// Fit the history into the chosen model's context window (not needed for the static "5" response)
+	if !(classificationPerformed && classificationNumber == "5") {
+		trimmedMessages, report, err := fitMessagesToContext(ctx, requestBody.Messages, chosenModel)
+		if err != nil {
+			requestErr = err
+			logger.Error("Context window exceeded", "error", err)
+			http.Error(w, "Bad Request: Conversation exceeds the context window of "+chosenModel, http.StatusBadRequest)
+			return
+		}
+		requestBody.Messages = trimmedMessages
+		contextReport = report
 	}
 
+	// Remember the decision so feedback on this request can be stored alongside it
+	storedPrompt, promptHash := storedContent(userInput)
+	recentDecisions.Add(routingDecision{
+		RequestID:            requestID,
+		APIKey:               key.Name,
+		Timestamp:            time.Now().UTC(),
+		RequestedModel:       requestBody.Model,
+		Category:             classificationNumber,
+		CategoryName:         classificationMap[classificationNumber].Name,
+		ClassificationSource: outcome.Source,
+		Model:                chosenModel,
+		Experiment:           assignment,
+		Prompt:               storedPrompt,
+		PromptHash:           promptHash,
+	})
+
 	// Construct metadata for the response
 	metaData := make(map[string]interface{})
+	metaData["request_id"] = requestID // Used to reference this request in POST /api/feedback and in logs
+	if requestBody.ConversationID != "" {
+		metaData["conversation_id"] = requestBody.ConversationID
+	}
 	metaData["requested_model_parameter"] = requestBody.Model // What user sent in "model"
 	metaData["classification_performed"] = classificationPerformed
 	if classificationPerformed {
 		metaData["classification_result_name"] = classificationNameForMetadata
 		metaData["model_selected_by_classification"] = modelSelectedByClassification
+		metaData["classification_source"] = outcome.Source
+		if outcome.Rule != "" {
+			metaData["classification_rule"] = outcome.Rule
+			metaData["classification_rule_confidence"] = outcome.Confidence
+		}
+		if outcome.FallbackReason != "" {
+			metaData["classification_fallback_reason"] = outcome.FallbackReason
+		}
+		if routing != nil {
+			metaData["routing"] = routing
+		}
+		if assignment != nil {
+			metaData["experiment"] = assignment
+		}
 	}
 	metaData["final_model_used_for_generation"] = chosenModel
+	if contextReport.CountMethod != "" {
+		metaData["estimated_prompt_tokens"] = contextReport.TokensAfter
+		metaData["token_count_method"] = contextReport.CountMethod
+		if cost, ok := estimateCostUSD(chosenModel, contextReport.TokensAfter, 0); ok {
+			metaData["estimated_prompt_cost_usd"] = cost
+		}
+	}
+	if len(contextReport.StrategiesApplied) > 0 {
+		metaData["context_management"] = contextReport
+	}
+
+	var replyToolCalls json.RawMessage
+	replyComplete := true // False if the stream failed or ended without [DONE]
 
+	generationStarted := time.Now()
 	if requestBody.Stream {
 		// Setup SSE headers
 		setupSSEHeaders(w)
@@ -291,9 +625,10 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			Data:  string(mustJSON(metaData)),
 		}
 		if err := writeSSE(w, initialEvent); err != nil {
-			log.Printf("ERROR: Failed to write initial SSE metadata event: %v", err)
+			requestErr = err
+			logger.Error("Failed to write initial SSE metadata event", "error", err)
 			// Client connection might be gone. Attempt to send a final [DONE] if possible.
-			sendDoneSSE(w)
+			sendDoneSSE(ctx, w)
 			return
 		}
 		w.(http.Flusher).Flush()
@@ -301,40 +636,50 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		// Handle Special Case: Content Generation (Static JSON Response, streamed)
 		// This applies only if model was "auto" and classification resulted in "5"
 		if classificationPerformed && classificationNumber == "5" {
-			log.Println("Handling classification '5' (Content Generation) by streaming static JSON.")
-			streamStaticContentForпять(w, chosenModel, classificationNameForMetadata) // Renamed "5" to "пять" to avoid syntax issues with numbers
-			sendDoneSSE(w)                                                            // Send data: [DONE] after static content
+			logger.Info("Handling classification '5' (Content Generation) by streaming static JSON")
+			streamStaticContentForпять(ctx, w, chosenModel, classificationNameForMetadata) // Renamed "5" to "пять" to avoid syntax issues with numbers
+			sendDoneSSE(ctx, w)                                                            // Send data: [DONE] after static content
+			assistantReply = string(mustJSON(generateStaticContentForFive()))
 		} else {
 			// Stream response from OpenRouter for other classifications or direct model
-			forwardedDone, streamErr := streamOpenRouterResponse(r.Context(), w, requestBody.Messages, chosenModel)
+			streamedContent, forwardedDone, streamErr := streamOpenRouterResponse(ctx, w, requestBody.Messages, chosenModel, requestBody.providerOptions)
+			assistantReply = streamedContent
+			replyComplete = streamErr == nil && forwardedDone
+			switch {
+			case streamErr != nil:
+				requestErr = streamErr
+			case !forwardedDone:
+				requestErr = errors.New("stream ended without [DONE]")
+			}
 			if streamErr != nil {
-				log.Printf("ERROR: Streaming OpenRouter response failed: %v", streamErr)
+				logger.Error("Streaming OpenRouter response failed", "error", streamErr)
 				// Attempt to send error to client if not already sent.
 				// streamOpenRouterResponse might have already written to w.
 				// Check if headers already sent. If not, can send HTTP error. But they are by now.
 				// So, send error in stream.
 				// Do not send another error if [DONE] was already forwarded, as the stream is over.
 				if !forwardedDone {
-					sendErrorSSE(w, fmt.Sprintf("Streaming error: %v", streamErr))
+					sendErrorSSE(ctx, w, fmt.Sprintf("Streaming error: %v", streamErr))
 				}
 			}
 			// If OpenRouter's stream didn't end with data: [DONE] or an error occurred before that,
 			// ensure our stream is properly terminated with data: [DONE].
 			if !forwardedDone {
-				sendDoneSSE(w)
+				sendDoneSSE(ctx, w)
 			}
 		}
-		log.Println("Finished streaming request.")
+		logger.Info("Finished streaming request", "duration_ms", time.Since(started).Milliseconds())
 
 	} else { // Non-streaming request
-		log.Printf("Handling non-streaming request for model: %s", chosenModel)
+		logger.Info("Handling non-streaming request", "model", chosenModel)
 		// For non-streaming, if classification was "5", what to do?
 		// The current logic for "5" is streaming. For non-streaming, we'd need a non-streaming static response.
 		// For now, let's assume non-streaming "5" (if auto-classified) will also attempt OpenRouter.
 		// Or, we can explicitly return the static content as a single JSON blob.
 		if classificationPerformed && classificationNumber == "5" {
-			log.Println("Handling classification '5' (Content Generation) non-streamed.")
+			logger.Info("Handling classification '5' (Content Generation) non-streamed")
 			staticResponse := generateStaticContentForFive()
+			assistantReply = string(mustJSON(staticResponse))
 			// Wrap it to look like an OpenRouter non-streaming response if desired, or send as is.
 			// For simplicity, sending the raw static content.
 			w.Header().Set("Content-Type", "application/json")
@@ -350,12 +695,14 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			// Call OpenRouter non-streamed
 			// The getOpenRouterResponseWithRetry function needs to accept messages
-			responseContent, err := getOpenRouterResponseWithRetry(requestBody.Messages, chosenModel, 3)
+			responseMessage, err := getOpenRouterResponseWithRetry(ctx, requestBody.Messages, chosenModel, requestBody.providerOptions, 3)
 			if err != nil {
-				log.Printf("ERROR: OpenRouter non-streaming request failed: %v", err)
+				requestErr = err
+				logger.Error("OpenRouter non-streaming request failed", "error", err)
 				http.Error(w, "Internal Server Error: Failed to get response from provider", http.StatusInternalServerError)
 				return
 			}
+			assistantReply, replyToolCalls = responseMessage.Content, responseMessage.ToolCalls
 
 			// Construct a response similar to OpenRouter's non-streaming format
 			// openRouterCompletionResponse is already defined for this.
@@ -370,7 +717,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 				Created: time.Now().Unix(),
 				Model:   chosenModel,
 				Choices: []openRouterChoice{
-					{Message: chatMessage{Role: "assistant", Content: responseContent}},
+					{Message: responseMessage},
 				},
 				// Usage: nil, // Not available from current getOpenRouterResponse
 			}
@@ -384,10 +731,48 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			if err := json.NewEncoder(w).Encode(finalResponse); err != nil {
-				log.Printf("ERROR: Failed to write non-streaming JSON response: %v", err)
+				logger.Error("Failed to write non-streaming JSON response", "error", err)
 			}
 		}
-		log.Println("Finished non-streaming request.")
+		logger.Info("Finished non-streaming request", "duration_ms", time.Since(started).Milliseconds())
+	}
+
+	// Token and cost counters (the static "5" response doesn't use a model)
+	audit.auditContent(userInput, assistantReply)
+	if assistantReply != "" && !(classificationPerformed && classificationNumber == "5") {
+		completionTokens, _ := countTextTokens(chosenModel, assistantReply)
+		recordTokenUsage(chosenModel, contextReport.TokensAfter, completionTokens)
+		audit.PromptTokens, audit.CompletionTokens = contextReport.TokensAfter, completionTokens
+	}
+
+	// Compare with the category's shadow model, if any, in the background
+	if shadowSlots != nil && classificationPerformed && classificationNumber != "5" && assistantReply != "" {
+		maybeShadow(shadowRecord{
+			Timestamp:  time.Now().UTC(),
+			RequestID:  requestID,
+			Category:   classificationNumber,
+			Stream:     requestBody.Stream,
+			Experiment: assignment,
+			Primary:    shadowOutput{Model: chosenModel, Output: assistantReply, LatencyMS: time.Since(generationStarted).Milliseconds()},
+		}, requestBody.Messages, requestBody.providerOptions)
+	}
+
+	// Store the new turn(s) and the reply. The request context may already be cancelled
+	// if the client disconnected at the end of the stream, so don't tie the write to it.
+	// A partial reply isn't stored, so the client can resend the turn.
+	if requestBody.ConversationID != "" && !replyComplete {
+		logger.Warn("Not storing turn, the reply is incomplete", "conversation_id", requestBody.ConversationID, "reply_chars", len(assistantReply))
+	} else if requestBody.ConversationID != "" && (assistantReply != "" || len(replyToolCalls) > 0) {
+		reply := storedMessage{Role: "assistant", Content: assistantReply, ToolCalls: replyToolCalls, Model: chosenModel, RequestID: requestID, CreatedAt: time.Now().UTC()}
+		if classificationPerformed {
+			reply.Classification = classificationNameForMetadata
+		}
+		turns := append(toStoredMessages(newTurns, requestID), reply)
+		storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if err := conversations.AppendMessages(storeCtx, conversationOwner(ctx), requestBody.ConversationID, turns); err != nil {
+			logger.Error("Failed to store turn", "conversation_id", requestBody.ConversationID, "error", err)
+		}
 	}
 }
 
@@ -397,32 +782,33 @@ func setupSSEHeaders(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no") // For Nginx
+	extendDeadlinesForStream(w)
 }
 
 // sendErrorSSE sends a standardized error event over SSE.
-func sendErrorSSE(w http.ResponseWriter, errorMessage string) {
+func sendErrorSSE(ctx context.Context, w http.ResponseWriter, errorMessage string) {
 	errorData := map[string]interface{}{"error": errorMessage, "done": false} // done is false as stream is not successfully done
 	errorEvent := ServerSentEvent{
 		Event: "error",
 		Data:  string(mustJSON(errorData)),
 	}
 	if err := writeSSE(w, errorEvent); err != nil {
-		log.Printf("ERROR: Failed to write error SSE event: %v", err)
+		logFor(ctx).Error("Failed to write error SSE event", "error", err)
 	}
 	w.(http.Flusher).Flush()
 }
 
 // sendDoneSSE sends the "data: [DONE]" signal over SSE.
-func sendDoneSSE(w http.ResponseWriter) {
+func sendDoneSSE(ctx context.Context, w http.ResponseWriter) {
 	if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err != nil {
-		log.Printf("ERROR: Failed to write [DONE] SSE event: %v", err)
+		logFor(ctx).Error("Failed to write [DONE] SSE event", "error", err)
 	}
 	w.(http.Flusher).Flush()
-	log.Println("Sent data: [DONE] event.")
+	logFor(ctx).Debug("Sent data: [DONE] event")
 }
 
 // streamStaticContentForпять handles streaming for classification "5"
-func streamStaticContentForпять(w http.ResponseWriter, modelName, classificationName string) {
+func streamStaticContentForпять(ctx context.Context, w http.ResponseWriter, modelName, classificationName string) {
 	staticResponse := generateStaticContentForFive()
 
 	// Send the static content as a single custom chunk
@@ -437,7 +823,7 @@ func streamStaticContentForпять(w http.ResponseWriter, modelName, classifica
 		})),
 	}
 	if err := writeSSE(w, chunkEvent); err != nil {
-		log.Printf("ERROR: Failed to write static content SSE event for classification 5: %v", err)
+		logFor(ctx).Error("Failed to write static content SSE event for classification 5", "error", err)
 		// Error event might be good here, but the stream is likely broken.
 		// The main handler will send [DONE] after this.
 	}
@@ -489,10 +875,10 @@ func extractUserPrompt(messages []chatMessage) (string, error) {
 	return "", fmt.Errorf("no user message found in messages")
 }
 
-// classifyPrompt sends the user input to a local Ollama instance for classification.
-// Now specifically using the classificationModel (gemma3:4b).
-func classifyPrompt(userInput string) (string, error) {
-	classificationPrompt := `Analyze the user\'s request below and classify it into one of the following categories.
+// buildClassificationPrompt wraps the user input in the category-selection instructions
+// shared by the Ollama classifier and the OpenRouter fallback classifier.
+func buildClassificationPrompt(userInput string) string {
+	return `Analyze the user\'s request below and classify it into one of the following categories.
 
 CONTEXT START
 ---
@@ -517,29 +903,43 @@ Classifications:
 Based *only* on the user\'s request provided in the CONTEXT, reply with *only* the single number corresponding to the best classification. Be conservative when choosing web-enabled classifications, as they are more resource-intensive - only if the prompt absolutely needs web access, choose 2.
 Do not reply with ANYHING But a number from 1 to 10. Only a number can be your output.
 `
+}
+
+// classifyPrompt sends the user input to a local Ollama instance for classification.
+// It uses classificationModel (gemma3:4b unless CLASSIFICATION_MODEL is set) at ollamaURL.
+func classifyPrompt(ctx context.Context, userInput string) (string, error) {
+	start := time.Now()
+	result := "error"
+	defer func() { observeSince(metricClassificationDuration, start, result) }()
+	ctx, span := startSpan(ctx, "ollama.classify", spanKindClient)
+	span.setAttribute("llm.model", classificationModel)
+	defer span.finish()
+	logger := logFor(ctx)
 
 	reqPayload := completionRequest{
 		Model:  classificationModel, // Use the specified classification model
-		Prompt: classificationPrompt,
+		Prompt: buildClassificationPrompt(userInput),
 		Stream: false,
 	}
 
 	reqBodyBytes, err := json.Marshal(reqPayload)
 	if err != nil {
-		log.Printf("ERROR: Failed to marshal classification request: %v", err)
+		logger.Error("Failed to marshal classification request", "error", err)
 		return "", err // Return specific error
 	}
 
-	// Context with timeout for the HTTP request
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second) // Increased timeout slightly
+	// Context with timeout for the HTTP request. Not cancelled with the client's request, so a
+	// disconnect isn't mistaken for Ollama being down.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 20*time.Second) // Increased timeout slightly
 	defer cancel()
 
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ollamaURL, bytes.NewBuffer(reqBodyBytes))
 	if err != nil {
-		log.Printf("ERROR: Failed to create Ollama request: %v", err)
+		logger.Error("Failed to create Ollama request", "error", err)
 		return "", err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	injectTraceparent(ctx, httpReq)
 
 	// Send request to Ollama
 	client := &http.Client{Timeout: 25 * time.Second} // Client timeout slightly longer than context
@@ -547,10 +947,14 @@ Do not reply with ANYHING But a number from 1 to 10. Only a number can be your o
 	if err != nil {
 		// Handle context deadline exceeded specifically if needed
 		if ctx.Err() == context.DeadlineExceeded {
-			log.Printf("ERROR: Ollama request timed out: %v", err)
+			logger.Error("Ollama request timed out", "error", err)
+			span.setError(err)
+			metricUpstreamErrors.add(1, "ollama", "timeout")
 			return "", ctx.Err() // Return timeout error
 		}
-		log.Printf("ERROR: Ollama request failed: %v", err)
+		logger.Error("Ollama request failed", "error", err)
+		span.setError(err)
+		metricUpstreamErrors.add(1, "ollama", "transport")
 		return "", err
 	}
 	defer resp.Body.Close()
@@ -558,70 +962,85 @@ Do not reply with ANYHING But a number from 1 to 10. Only a number can be your o
 	// Read and log the raw response body for debugging if status is not OK
 	respBodyBytes, readErr := io.ReadAll(resp.Body)
 	if readErr != nil {
-		log.Printf("ERROR: Failed to read Ollama response body: %v", readErr)
+		logger.Error("Failed to read Ollama response body", "error", readErr)
 		// Decide if you should return here or try to proceed if status was OK
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("ERROR: Ollama API returned non-OK status: %d. Body: %s", resp.StatusCode, string(respBodyBytes))
+		logger.Error("Ollama API returned non-OK status", "status", resp.StatusCode, contentAttr("body", string(respBodyBytes)))
 		// Consider returning a more specific error
 		// We should check for the "llama runner process has terminated" specifically if we want to give a helpful error.
 		if bytes.Contains(respBodyBytes, []byte("llama runner process has terminated")) {
-			log.Printf("SUGGESTION: The Ollama model process terminated. This often indicates insufficient system resources or a model issue. Consider using a smaller model or checking Ollama logs.")
+			logger.Warn("The Ollama model process terminated. This often indicates insufficient system resources or a model issue. Consider using a smaller model or checking Ollama logs.")
 		}
-		return "", err // Or a custom error: fmt.Errorf("Ollama classification API error: status %d, body: %s", resp.StatusCode, string(respBodyBytes))
+		metricUpstreamErrors.add(1, "ollama", strconv.Itoa(resp.StatusCode))
+		err := fmt.Errorf("Ollama classification API error: status %d", resp.StatusCode)
+		span.setError(err)
+		return "", err
 	}
 
 	// Decode the successful response
 	var ollamaResp ollamaResponse
 	// Use the already read body bytes to avoid reading again
 	if err := json.Unmarshal(respBodyBytes, &ollamaResp); err != nil {
-		log.Printf("ERROR: Failed to decode Ollama response JSON: %v. Body: %s", err, string(respBodyBytes))
+		logger.Error("Failed to decode Ollama response JSON", "error", err, contentAttr("body", string(respBodyBytes)))
 		return "", err
 	}
 
 	// Basic validation/cleaning of the response (expecting just a number)
 	// Trim whitespace and potentially other non-numeric characters if needed
 	classificationResult := bytes.TrimSpace([]byte(ollamaResp.Response))
-	log.Printf("DEBUG: Raw classification response from Ollama: '%s'", ollamaResp.Response)
+	logger.Debug("Raw classification response from Ollama", contentAttr("response", ollamaResp.Response))
 
 	// Add more robust validation if necessary (e.g., check if it's actually a number within the expected range)
 	_, ok := classificationMap[string(classificationResult)]
 	if !ok {
-		log.Printf("WARN: Ollama returned an unexpected classification: '%s'. Defaulting or erroring might be needed.", classificationResult)
+		logger.Warn("Ollama returned an unexpected classification. Defaulting or erroring might be needed.", contentAttr("response", string(classificationResult)))
 		// Decide how to handle - return error, default, retry? For now, return what we got.
 	}
 
+	span.setAttribute("llm.category", string(classificationResult))
+	result = "ok"
 	return string(classificationResult), nil
 }
 
 // getOpenRouterResponse sends the prompt to OpenRouter (non-streaming).
 // TODO: This function should ideally return the full openRouterCompletionResponse object, not just the content string,
 // to allow the handler to construct a more accurate non-streaming JSON response.
-func getOpenRouterResponse(messages []chatMessage, modelName string) (string, error) {
+func getOpenRouterResponse(ctx context.Context, messages []chatMessage, modelName string) (string, error) {
+	message, err := getOpenRouterMessage(ctx, messages, modelName, providerOptions{})
+	return message.Content, err
+}
+
+// getOpenRouterMessage is getOpenRouterResponse with pass-through options, returning the whole
+// assistant message so tool calls are kept.
+func getOpenRouterMessage(ctx context.Context, messages []chatMessage, modelName string, opts providerOptions) (chatMessage, error) {
+	logger := logFor(ctx).With("model", modelName)
 	// Use the Chat Completions format for OpenRouter
 	reqPayload := completionRequest{ // This matches the external API struct now
-		Model:    modelName,
-		Messages: messages,
-		Stream:   false, // Explicitly false for this function
+		Model:           modelName,
+		Messages:        messages,
+		Stream:          false, // Explicitly false for this function
+		providerOptions: opts,
 		// Add other parameters like temperature, max_tokens if needed by passing them through
 	}
 
 	reqBodyBytes, err := json.Marshal(reqPayload)
 	if err != nil {
-		log.Printf("ERROR: Failed to marshal OpenRouter request: %v", err)
-		return "", err
+		logger.Error("Failed to marshal OpenRouter request", "error", err)
+		return chatMessage{}, err
 	}
 
 	// Context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second) // Longer timeout for potentially complex generation
+	ctx, cancel := context.WithTimeout(ctx, 45*time.Second) // Longer timeout for potentially complex generation
 	defer cancel()
 
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, openrouterURL, bytes.NewBuffer(reqBodyBytes))
 	if err != nil {
-		log.Printf("ERROR: Failed to create OpenRouter request: %v", err)
-		return "", err
+		logger.Error("Failed to create OpenRouter request", "error", err)
+		return chatMessage{}, err
 	}
+	injectTraceparent(ctx, httpReq)
 
 	// Set Headers
 	httpReq.Header.Set("Content-Type", "application/json")
@@ -635,87 +1054,120 @@ func getOpenRouterResponse(messages []chatMessage, modelName string) (string, er
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			log.Printf("ERROR: OpenRouter request timed out: %v", err)
-			return "", ctx.Err()
+			logger.Error("OpenRouter request timed out", "error", err)
+			metricUpstreamErrors.add(1, "openrouter", "timeout")
+			return chatMessage{}, ctx.Err()
 		}
-		log.Printf("ERROR: OpenRouter request failed: %v", err)
-		return "", err
+		logger.Error("OpenRouter request failed", "error", err)
+		metricUpstreamErrors.add(1, "openrouter", "transport")
+		return chatMessage{}, err
 	}
 	defer resp.Body.Close()
 
 	// Read response body for potential error logging
 	respBodyBytes, readErr := io.ReadAll(resp.Body)
 	if readErr != nil {
-		log.Printf("ERROR: Failed to read OpenRouter response body: %v", readErr)
+		logger.Error("Failed to read OpenRouter response body", "error", readErr)
 		// Continue to check status code, but log this failure
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("ERROR: OpenRouter API returned non-OK status: %d. Body: %s", resp.StatusCode, string(respBodyBytes))
+		logger.Error("OpenRouter API returned non-OK status", "status", resp.StatusCode, contentAttr("body", string(respBodyBytes)))
 		// Consider returning a more specific error based on status code
-		return "", err // Or a custom error: fmt.Errorf("OpenRouter API error: status %d", resp.StatusCode)
+		metricUpstreamErrors.add(1, "openrouter", strconv.Itoa(resp.StatusCode))
+		return chatMessage{}, fmt.Errorf("OpenRouter API error: status %d", resp.StatusCode)
 	}
 
 	// Decode successful response
 	var openRouterResp openRouterCompletionResponse
 	if err := json.Unmarshal(respBodyBytes, &openRouterResp); err != nil {
-		log.Printf("ERROR: Failed to decode OpenRouter response JSON: %v. Body: %s", err, string(respBodyBytes))
-		return "", err
+		logger.Error("Failed to decode OpenRouter response JSON", "error", err, contentAttr("body", string(respBodyBytes)))
+		return chatMessage{}, err
 	}
 
 	// Extract the content from the first choice
-	if len(openRouterResp.Choices) == 0 || openRouterResp.Choices[0].Message.Content == "" {
-		log.Printf("WARN: OpenRouter response contained no choices or empty content. Body: %s", string(respBodyBytes))
+	if len(openRouterResp.Choices) == 0 || (openRouterResp.Choices[0].Message.Content == "" && len(openRouterResp.Choices[0].Message.ToolCalls) == 0) {
+		logger.Warn("OpenRouter response contained no choices or empty content", contentAttr("body", string(respBodyBytes)))
 		// Decide how to handle: return error, empty string, default message?
-		return "", fmt.Errorf("no content in OpenRouter response: %s", string(respBodyBytes))
+		return chatMessage{}, errors.New("no content in OpenRouter response")
 	}
 
-	return openRouterResp.Choices[0].Message.Content, nil
+	return openRouterResp.Choices[0].Message, nil
 }
 
 // streamOpenRouterResponse sends a streaming request to OpenRouter and forwards chunks to the client.
-// Returns true if "data: [DONE]" was successfully forwarded, false otherwise.
-func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messages []chatMessage, modelName string) (bool, error) {
+// Returns the streamed content and true if "data: [DONE]" was successfully forwarded, false otherwise.
+// If the server shuts down before the stream ends, the error is errServerShuttingDown.
+func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messages []chatMessage, modelName string, opts providerOptions) (string, bool, error) {
+	ctx, untrack := activeStreams.track(ctx)
+	defer untrack()
+	ctx, span := startSpan(ctx, "openrouter.stream", spanKindClient)
+	span.setAttribute("llm.model", modelName)
+	content, forwardedDone, err := forwardOpenRouterStream(ctx, w, messages, modelName, opts)
+	if err != nil && errors.Is(context.Cause(ctx), errServerShuttingDown) {
+		err = errServerShuttingDown
+	}
+	span.setAttribute("llm.response_chars", len(content))
+	span.setAttribute("stream.forwarded_done", forwardedDone)
+	span.setError(err)
+	span.finish()
+	return content, forwardedDone, err
+}
+
+// forwardOpenRouterStream does the work of streamOpenRouterResponse within its span.
+func forwardOpenRouterStream(ctx context.Context, w http.ResponseWriter, messages []chatMessage, modelName string, opts providerOptions) (string, bool, error) {
+	logger := logFor(ctx).With("model", modelName)
 	// Create the OpenRouter request payload with streaming enabled
 	reqPayload := completionRequest{ // This matches the external API struct
-		Model:    modelName,
-		Messages: messages,
-		Stream:   true,
+		Model:           modelName,
+		Messages:        messages,
+		Stream:          true,
+		providerOptions: opts,
 	}
 
 	reqBodyBytes, err := json.Marshal(reqPayload)
 	if err != nil {
-		return false, fmt.Errorf("failed to marshal OpenRouter request: %w", err)
+		return "", false, fmt.Errorf("failed to marshal OpenRouter request: %w", err)
 	}
 
 	// Create HTTP request with context
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, openrouterURL, bytes.NewBuffer(reqBodyBytes))
 	if err != nil {
-		return false, fmt.Errorf("failed to create OpenRouter request: %w", err)
+		return "", false, fmt.Errorf("failed to create OpenRouter request: %w", err)
 	}
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+os.Getenv("OPENROUTER_API_KEY"))
 	httpReq.Header.Set("Accept", "text/event-stream")
+	injectTraceparent(ctx, httpReq)
 
 	// Send request
 	client := &http.Client{Timeout: 120 * time.Second} // Longer timeout for streaming
+	start := time.Now()
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		return false, fmt.Errorf("OpenRouter request failed: %w", err)
+		metricUpstreamErrors.add(1, "openrouter", "transport")
+		return "", false, fmt.Errorf("OpenRouter request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return false, fmt.Errorf("OpenRouter API returned non-OK status: %d. Body: %s", resp.StatusCode, string(respBody))
+		metricUpstreamErrors.add(1, "openrouter", strconv.Itoa(resp.StatusCode))
+		logger.Error("OpenRouter API returned non-OK status", "status", resp.StatusCode, contentAttr("body", string(respBody)))
+		return "", false, fmt.Errorf("OpenRouter API returned non-OK status: %d", resp.StatusCode)
 	}
 
+	metricActiveStreams.add(1)
+	defer metricActiveStreams.add(-1)
+	defer observeSince(metricStreamDuration, start, modelLabel(modelName))
+
 	// Process streaming response
 	reader := bufio.NewReader(resp.Body)
-	var contentBuilder strings.Builder // Kept for potential future use like full response logging
+	var contentBuilder strings.Builder // Accumulates the assistant reply for conversation storage
 	var forwardedDone bool
+	firstChunk := true
 
 	for {
 		// Read one line from the stream, ending in \n
@@ -727,17 +1179,17 @@ func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messag
 					trimmedLine := strings.TrimSpace(string(lineBytes))
 					if trimmedLine != "" { // Only process if not just whitespace
 						if _, writeErr := w.Write(lineBytes); writeErr != nil {
-							log.Printf("ERROR: Failed to write trailing SSE data on EOF: %v", writeErr)
+							logger.Error("Failed to write trailing SSE data on EOF", "error", writeErr)
 							// Don't return error here, as EOF is expected. Let main logic handle [DONE] if not sent.
 						} else {
 							// Send the second newline for SSE message termination
 							if _, writeErr := w.Write([]byte("\n")); writeErr != nil {
-								log.Printf("ERROR: Failed to write trailing SSE terminator on EOF: %v", writeErr)
+								logger.Error("Failed to write trailing SSE terminator on EOF", "error", writeErr)
 							}
 						}
 						w.(http.Flusher).Flush()
 						if trimmedLine == "data: [DONE]" {
-							log.Println("Successfully forwarded data: [DONE] from OpenRouter (on EOF).")
+							logger.Debug("Forwarded data: [DONE] from OpenRouter (on EOF)")
 							forwardedDone = true
 						}
 					}
@@ -745,8 +1197,8 @@ func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messag
 				break // Expected end of stream
 			}
 			// For other errors, log and return
-			log.Printf("ERROR: Error reading stream from OpenRouter: %v", err)
-			return forwardedDone, fmt.Errorf("error reading stream from OpenRouter: %w", err)
+			logger.Error("Error reading stream from OpenRouter", "error", err)
+			return contentBuilder.String(), forwardedDone, fmt.Errorf("error reading stream from OpenRouter: %w", err)
 		}
 
 		trimmedLine := strings.TrimSpace(string(lineBytes))
@@ -758,19 +1210,19 @@ func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messag
 
 		// Forward the line (which includes "data: ..." and the first "\n")
 		if _, err := w.Write(lineBytes); err != nil {
-			log.Printf("ERROR: Failed to write SSE data: %v", err)
-			return forwardedDone, fmt.Errorf("failed to write SSE data: %w", err)
+			logger.Error("Failed to write SSE data", "error", err)
+			return contentBuilder.String(), forwardedDone, fmt.Errorf("failed to write SSE data: %w", err)
 		}
 		// Send the second newline for SSE message termination
 		if _, err := w.Write([]byte("\n")); err != nil {
-			log.Printf("ERROR: Failed to write SSE terminator: %v", err)
-			return forwardedDone, fmt.Errorf("failed to write SSE terminator: %w", err)
+			logger.Error("Failed to write SSE terminator", "error", err)
+			return contentBuilder.String(), forwardedDone, fmt.Errorf("failed to write SSE terminator: %w", err)
 		}
 		w.(http.Flusher).Flush()
 
 		// Log the content being streamed for debugging (optional)
 		// Be cautious with logging entire chunks if they are large or frequent.
-		// log.Printf("Streamed chunk: %s", trimmedLine)
+		// logger.Debug("Streamed chunk", "line", trimmedLine)
 
 		if strings.HasPrefix(trimmedLine, "data: ") {
 			dataContent := strings.TrimPrefix(trimmedLine, "data: ")
@@ -778,6 +1230,12 @@ func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messag
 				var chunk StreamChunk
 				if err := json.Unmarshal([]byte(dataContent), &chunk); err == nil {
 					if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+						if firstChunk {
+							modelLatencies.observe(modelName, time.Since(start)) // Time to first token
+							observeSince(metricTimeToFirstToken, start, modelLabel(modelName))
+							spanFromContext(ctx).addEvent("first_token", nil)
+							firstChunk = false
+						}
 						contentBuilder.WriteString(chunk.Choices[0].Delta.Content)
 					}
 				}
@@ -785,18 +1243,18 @@ func streamOpenRouterResponse(ctx context.Context, w http.ResponseWriter, messag
 		}
 
 		if trimmedLine == "data: [DONE]" {
-			log.Println("Successfully forwarded data: [DONE] from OpenRouter.")
+			logger.Debug("Forwarded data: [DONE] from OpenRouter")
 			forwardedDone = true
 			break // End of stream from OpenRouter
 		}
 	}
 
 	if forwardedDone {
-		log.Printf("Successfully streamed full response from OpenRouter, forwarded [DONE]. Total content characters (approx): %d", contentBuilder.Len())
+		logger.Info("Streamed full response from OpenRouter, forwarded [DONE]", "content_chars", contentBuilder.Len())
 	} else {
-		log.Printf("Streaming from OpenRouter finished but [DONE] was not explicitly forwarded. Total content characters (approx): %d", contentBuilder.Len())
+		logger.Warn("Streaming from OpenRouter finished but [DONE] was not explicitly forwarded", "content_chars", contentBuilder.Len())
 	}
-	return forwardedDone, nil
+	return contentBuilder.String(), forwardedDone, nil
 }
 
 // writeSSE writes a server-sent event to the response writer
@@ -812,6 +1270,16 @@ func writeSSE(w http.ResponseWriter, event ServerSentEvent) error {
 	return nil
 }
 
+// randomID returns a random identifier for requests and conversations.
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand failing is practically impossible; fall back to a time-based ID
+		return fmt.Sprintf("req-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
 // mustJSON marshals an object to JSON, panicking on error
 func mustJSON(v interface{}) []byte {
 	data, err := json.Marshal(v)
@@ -821,15 +1289,20 @@ func mustJSON(v interface{}) []byte {
 	return data
 }
 
-// getOpenRouterResponseWithRetry wraps getOpenRouterResponse with exponential backoff retry logic.
+// getOpenRouterResponseWithRetry wraps getOpenRouterMessage with exponential backoff retry logic.
 // It now accepts messages []chatMessage instead of userInput.
-func getOpenRouterResponseWithRetry(messages []chatMessage, modelName string, maxRetries int) (string, error) {
+func getOpenRouterResponseWithRetry(ctx context.Context, messages []chatMessage, modelName string, opts providerOptions, maxRetries int) (chatMessage, error) {
 	var lastErr error
 	baseDelay := 1 * time.Second // Initial delay
+	logger := logFor(ctx).With("model", modelName)
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		// getOpenRouterResponse now takes messages and modelName
-		response, err := getOpenRouterResponse(messages, modelName)
+		attemptCtx, span := startSpan(ctx, "openrouter.chat", spanKindClient)
+		span.setAttribute("llm.model", modelName)
+		span.setAttribute("retry.attempt", attempt+1)
+		response, err := getOpenRouterMessage(attemptCtx, messages, modelName, opts)
+		span.setError(err)
+		span.finish()
 		if err == nil {
 			// Success
 			return response, nil
@@ -837,7 +1310,7 @@ func getOpenRouterResponseWithRetry(messages []chatMessage, modelName string, ma
 
 		// Store the last error encountered
 		lastErr = err
-		log.Printf("WARN: OpenRouter attempt %d/%d failed: %v", attempt+1, maxRetries, err)
+		logger.Warn("OpenRouter attempt failed", "attempt", attempt+1, "max_attempts", maxRetries, "error", err)
 
 		// Check if the error indicates a timeout or a potentially temporary server issue
 		// Add more specific error checks if needed (e.g., rate limits 429)
@@ -848,29 +1321,29 @@ func getOpenRouterResponseWithRetry(messages []chatMessage, modelName string, ma
 			jitter := time.Duration(time.Now().UnixNano()%1000) * time.Millisecond
 			actualDelay := delay + jitter
 
-			log.Printf("Retrying OpenRouter request in %v...", actualDelay)
+			logger.Info("Retrying OpenRouter request", "delay", actualDelay.String())
+			metricUpstreamRetries.add(1, modelLabel(modelName))
 			time.Sleep(actualDelay)
 		} else {
 			// Don't retry on non-transient errors (like bad request 4xx, auth errors 401/403)
-			log.Printf("Not retrying due to non-transient error: %v", err)
+			logger.Info("Not retrying due to non-transient error", "error", err)
 			break // Exit the retry loop
 		}
 	}
 
-	log.Printf("ERROR: OpenRouter request failed after %d attempts.", maxRetries)
-	return "", lastErr // Return the last error encountered
+	logger.Error("OpenRouter request failed after all attempts", "attempts", maxRetries)
+	return chatMessage{}, lastErr // Return the last error encountered
 }
 
-// jsonResponse is a helper to marshal data to JSON and write it to the response writer.
-// This function is no longer directly used by the main handler path for successful responses,
-// but might be kept for other purposes or future use.
-// If it's definitely not needed, it could be removed. For now, let's keep it.
+// jsonResponse marshals data to JSON and writes it to the response writer. The management and
+// reporting endpoints (models, conversations, cache, experiments, health, tokenize) answer with it;
+// it writes a 200 unless the handler has already written a status.
 func jsonResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	// Marshal the data
 	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("ERROR: Failed to marshal JSON response: %v", err)
+		slog.Error("Failed to marshal JSON response", "error", err)
 		http.Error(w, `{"error": "Internal Server Error: Failed to encode response"}`, http.StatusInternalServerError)
 		return
 	}
@@ -879,6 +1352,6 @@ func jsonResponse(w http.ResponseWriter, data interface{}) {
 	_, err = w.Write(jsonBytes)
 	if err != nil {
 		// This error usually means the client disconnected, log it but often can't fix it server-side
-		log.Printf("ERROR: Failed to write JSON response to client: %v", err)
+		slog.Error("Failed to write JSON response to client", "error", err)
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Helpers shared by the package's tests.
+
+// stubOpenRouter serves canned chat completions in place of OpenRouter, streamed as SSE (with a
+// usage chunk if requested) when the request asks for it, and records the request bodies it
+// received. With truncate set, streams end without [DONE], as when the upstream connection drops.
+// With stall set, streams send their first chunk and then hang until the caller gives up.
+type stubOpenRouter struct {
+	*httptest.Server
+	reply    string
+	truncate bool
+	stall    bool
+
+	mu       sync.Mutex
+	requests []completionRequest
+}
+
+func newStubOpenRouter(t *testing.T, reply string) *stubOpenRouter {
+	t.Helper()
+	stub := &stubOpenRouter{reply: reply}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req completionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stub.mu.Lock()
+		stub.requests = append(stub.requests, req)
+		stub.mu.Unlock()
+		if !req.Stream {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "stub", "object": "chat.completion", "model": req.Model,
+				"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": stub.reply}}},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range strings.SplitAfter(stub.reply, " ") {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"id": "stub", "object": "chat.completion.chunk", "model": req.Model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": map[string]string{"content": word}}},
+			})
+			io.WriteString(w, "data: "+string(chunk)+"\n\n")
+			if stub.stall {
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+		}
+		if bytes.Contains(req.Usage, []byte(`"include":true`)) {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"id": "stub", "object": "chat.completion.chunk", "model": req.Model, "choices": []interface{}{},
+				"usage": map[string]interface{}{"prompt_tokens": 12, "completion_tokens": len(strings.Fields(stub.reply)), "cost": 0.0001},
+			})
+			io.WriteString(w, "data: "+string(chunk)+"\n\n")
+		}
+		if !stub.truncate {
+			io.WriteString(w, "data: [DONE]\n\n")
+		}
+	}))
+	previous := openrouterURL
+	openrouterURL = stub.URL + "/v1/chat/completions"
+	t.Cleanup(func() {
+		openrouterURL = previous
+		stub.Close()
+	})
+	return stub
+}
+
+// received returns the request bodies the stub has seen.
+func (s *stubOpenRouter) received() []completionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]completionRequest(nil), s.requests...)
+}
+
+// captureLogs sends the default logger's output, at debug level and through redactingHandler as
+// in production, to the returned buffer for the rest of the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(redactingHandler{inner: slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of background goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// setupTestRouter loads the embedded model registry and the development API key, and returns the
+// server's handler.
+func setupTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	if err := initModelRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+	return newRouter(routes)
+}
+
+// postJSON sends an authorized POST with a JSON body through handler.
+func postJSON(handler http.Handler, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(authHeaderKey, authHeaderValue)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
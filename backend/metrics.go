@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Prometheus metrics ---
+//
+// A minimal implementation of counters, gauges and histograms with labels, exposed on /metrics
+// in the Prometheus text format. /metrics is not behind the Authorization check so it can be
+// scraped; it exposes counts and model names only.
+
+// metricVec is a counter or gauge with labels.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]float64 // Joined label values -> value
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// metricWriter is implemented by every registered metric.
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+var metricsRegistry []metricWriter
+
+// labelSeparator joins label values into series keys.
+const labelSeparator = "\xff"
+
+var (
+	latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	streamBuckets  = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 90, 120}
+
+	metricRequests = newCounterVec("llm_router_requests_total",
+		"HTTP requests by route, status, model and category.", "route", "status", "model", "category")
+	metricClassificationDuration = newHistogramVec("llm_router_classification_duration_seconds",
+		"Duration of Ollama classification calls.", latencyBuckets, "result")
+	metricTimeToFirstToken = newHistogramVec("llm_router_time_to_first_token_seconds",
+		"Time from sending a streaming request to OpenRouter until the first content token.", latencyBuckets, "model")
+	metricStreamDuration = newHistogramVec("llm_router_stream_duration_seconds",
+		"Total duration of streams from OpenRouter.", streamBuckets, "model")
+	metricUpstreamErrors = newCounterVec("llm_router_upstream_errors_total",
+		"Failed upstream calls by upstream and HTTP status (\"transport\" for connection errors).", "upstream", "status")
+	metricUpstreamRetries = newCounterVec("llm_router_upstream_retries_total",
+		"Retries of non-streaming OpenRouter requests.", "model")
+	metricActiveStreams = newGaugeVec("llm_router_active_streams",
+		"Streams from OpenRouter currently being forwarded.")
+	metricTokens = newCounterVec("llm_router_tokens_total",
+		"Estimated prompt and completion tokens by model.", "model", "type")
+	metricCost = newCounterVec("llm_router_cost_usd_total",
+		"Estimated cost in USD by model, from registry pricing.", "model")
+	metricAuditErrors = newCounterVec("llm_router_audit_write_errors_total",
+		"Audit records that could not be written to the audit sink.")
+	metricRateLimited = newCounterVec("llm_router_rate_limited_total",
+		"Requests rejected by the rate limit, by API key name.", "api_key")
+	metricPanics = newCounterVec("llm_router_handler_panics_total",
+		"Handler panics recovered by recoverPanics.")
+)
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return registerMetricVec(&metricVec{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)})
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return registerMetricVec(&metricVec{name: name, help: help, kind: "gauge", labels: labels, values: make(map[string]float64)})
+}
+
+func registerMetricVec(v *metricVec) *metricVec {
+	metricsRegistry = append(metricsRegistry, v)
+	return v
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+// add adds delta to the series with the given label values (in the order of the labels).
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.name) // Unlabelled metrics always have their one series
+	}
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, key, ""), formatMetricValue(v.values[key]))
+	}
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {a="x",b="y"}, adding le for histogram buckets.
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSeparator)
+		for i, name := range names {
+			var value string
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// recordTokenUsage adds a request's tokens and estimated cost to the counters.
+func recordTokenUsage(model string, promptTokens, completionTokens int) {
+	label := modelLabel(model)
+	metricTokens.add(float64(promptTokens), label, "prompt")
+	metricTokens.add(float64(completionTokens), label, "completion")
+	if cost, ok := estimateCostUSD(model, promptTokens, completionTokens); ok {
+		metricCost.add(cost, label)
+	}
+}
+
+// modelLabel is the model label value for a metric. Models not in the registry, which clients can
+// request when MODEL_REGISTRY_STRICT=false, share the label "other" so they can't grow the number
+// of series without bound.
+func modelLabel(model string) string {
+	if model == "" {
+		return ""
+	}
+	if _, ok := models.Lookup(model); !ok {
+		return "other"
+	}
+	return model
+}
+
+// statusRecorder captures the response status, and the model and category set by the handler,
+// for the request counter, along with the request's audit record.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	model    string
+	category string
+	audit    auditRecord
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to extend deadlines.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// setMetricLabels records the model and category of a request for the request counter.
+func setMetricLabels(w http.ResponseWriter, model, category string) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.model, rec.category = model, category
+	}
+}
+
+// instrumentHandler counts requests to a route by status, model and category, traces them and
+// writes them to the audit log.
+func instrumentHandler(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		ctx, span := startServerSpan(r, r.Method+" "+route)
+		span.setAttribute("http.request.method", r.Method)
+		span.setAttribute("http.route", route)
+		rec := &statusRecorder{ResponseWriter: w}
+		if requestID := requestIDFromContext(ctx); requestID != "" {
+			rec.audit.RequestID = requestID
+			span.setAttribute("request.id", requestID)
+		}
+		h(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metricRequests.add(1, route, strconv.Itoa(rec.status), modelLabel(rec.model), rec.category)
+		writeAudit(rec, r, route, started)
+		span.setAttribute("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.setError(fmt.Errorf("status %d", rec.status))
+		}
+		span.finish()
+	}
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.writeTo(w)
+	}
+}
+
+// observeSince records the seconds elapsed since start in a histogram.
+func observeSince(h *histogramVec, start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsLabelUnknownModelsAsOther(t *testing.T) {
+	if err := withModelRegistry(t, "", "false"); err != nil {
+		t.Fatal(err)
+	}
+	handler := setupTestRouter(t)
+	newStubOpenRouter(t, "Hello.")
+
+	for _, model := range []string{"made-up/model-1", "made-up/model-2", "openai/gpt-4.1-mini"} {
+		rec := postJSON(handler, "/api/chat", `{"model":"`+model+`","messages":[{"role":"user","content":"Hi"}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", model, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if strings.Contains(body, "made-up/") {
+		t.Errorf("client-supplied model names became label values:\n%s", body)
+	}
+	for _, want := range []string{`model="other"`, `model="openai/gpt-4.1-mini"`} {
+		if !strings.Contains(body, `llm_router_requests_total{route="/api/chat",status="200",`+want) {
+			t.Errorf("no request series with %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestModelLabel(t *testing.T) {
+	setupTestRouter(t)
+	tests := map[string]string{
+		"":                                "",
+		"anthropic/claude-sonnet-4":       "anthropic/claude-sonnet-4",
+		"openai/gpt-4.1-mini:online":      "openai/gpt-4.1-mini:online",
+		"someone/anything-they-like":      "other",
+		"anthropic/claude-sonnet-4:extra": "other",
+	}
+	for model, want := range tests {
+		if got := modelLabel(model); got != want {
+			t.Errorf("modelLabel(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
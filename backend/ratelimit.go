@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Rate limiting ---
+//
+// Each API key may make RATE_LIMIT_PER_MINUTE requests per minute (0, the default, means no
+// limit), or its own "requests_per_minute" from API_KEYS_FILE. Requests are drawn from a token
+// bucket holding up to RATE_LIMIT_BURST requests (default: one minute's worth), so short bursts
+// are fine as long as the average stays within the limit. Requests over the limit get a 429
+// with Retry-After.
+
+// rateLimitConfig holds the rate limit settings.
+type rateLimitConfig struct {
+	PerMinute int // Default for keys without their own limit; 0 disables it
+	Burst     int // 0 uses the key's per-minute limit
+}
+
+var (
+	rateLimitSettings rateLimitConfig
+	rateLimiter       = &keyRateLimiter{buckets: make(map[string]*tokenBucket)}
+)
+
+// initRateLimits reads RATE_LIMIT_PER_MINUTE and RATE_LIMIT_BURST.
+func initRateLimits() error {
+	cfg := rateLimitSettings
+	cfg.PerMinute = envInt("RATE_LIMIT_PER_MINUTE", cfg.PerMinute)
+	cfg.Burst = envInt("RATE_LIMIT_BURST", cfg.Burst)
+	if cfg.PerMinute < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("RATE_LIMIT_PER_MINUTE and RATE_LIMIT_BURST must not be negative")
+	}
+	for _, key := range apiKeys {
+		if key.RequestsPerMinute < 0 {
+			return fmt.Errorf("API key %s has a negative requests_per_minute", key.Name)
+		}
+	}
+	rateLimitSettings = cfg
+	slog.Info("Rate limits configured", "per_minute", cfg.PerMinute, "burst", cfg.Burst)
+	return nil
+}
+
+// requestsPerMinute returns the key's rate limit, 0 if it has none.
+func (k *apiKey) requestsPerMinute() int {
+	if k.RequestsPerMinute > 0 {
+		return k.RequestsPerMinute
+	}
+	return rateLimitSettings.PerMinute
+}
+
+// tokenBucket is the request allowance of one key.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// keyRateLimiter holds a token bucket per API key name.
+type keyRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow takes a token from the key's bucket, refilled at perMinute tokens per minute up to burst.
+// If the bucket is empty it returns false and how long until the next token.
+func (l *keyRateLimiter) allow(name string, perMinute, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		l.buckets[name] = b
+	}
+	perSecond := float64(perMinute) / 60
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// rateLimit answers 429 when the request's API key has used up its rate limit. It runs after
+// requireAPIKey.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromContext(r.Context())
+		perMinute := 0
+		if key != nil {
+			perMinute = key.requestsPerMinute()
+		}
+		if perMinute == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		burst := rateLimitSettings.Burst
+		if burst == 0 {
+			burst = perMinute
+		}
+		if ok, retryAfter := rateLimiter.allow(key.Name, perMinute, burst, time.Now()); !ok {
+			metricRateLimited.add(1, key.Name)
+			logFor(r.Context()).Warn("Rate limit exceeded", "api_key", key.Name, "per_minute", perMinute)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too Many Requests: Rate limit of %d requests per minute exceeded", perMinute), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyRateLimiterAllow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		at        []time.Duration // Offsets from start of each request
+		want      []bool
+	}{
+		{"burst then empty", 60, 2, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"refills over time", 60, 1, []time.Duration{0, 500 * time.Millisecond, time.Second}, []bool{true, false, true}},
+		{"refill capped at burst", 60, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &keyRateLimiter{buckets: make(map[string]*tokenBucket)}
+			for i, offset := range tt.at {
+				ok, retryAfter := limiter.allow("key", tt.perMinute, tt.burst, start.Add(offset))
+				if ok != tt.want[i] {
+					t.Fatalf("request %d: allowed = %v, want %v", i, ok, tt.want[i])
+				}
+				if !ok && retryAfter <= 0 {
+					t.Errorf("request %d: retry after %v, want a positive wait", i, retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	previousSettings, previousLimiter := rateLimitSettings, rateLimiter
+	t.Cleanup(func() { rateLimitSettings, rateLimiter = previousSettings, previousLimiter })
+
+	tests := []struct {
+		name      string
+		settings  rateLimitConfig
+		key       *apiKey
+		requests  int
+		wantCodes []int
+	}{
+		{"no limit", rateLimitConfig{}, &apiKey{Name: "a"}, 3, []int{200, 200, 200}},
+		{"default limit", rateLimitConfig{PerMinute: 2}, &apiKey{Name: "a"}, 3, []int{200, 200, 429}},
+		{"key override", rateLimitConfig{PerMinute: 100}, &apiKey{Name: "a", RequestsPerMinute: 1}, 2, []int{200, 429}},
+		{"burst setting", rateLimitConfig{PerMinute: 60, Burst: 1}, &apiKey{Name: "a"}, 2, []int{200, 429}},
+		{"public route without key", rateLimitConfig{PerMinute: 1}, nil, 3, []int{200, 200, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimitSettings = tt.settings
+			rateLimiter = &keyRateLimiter{buckets: make(map[string]*tokenBucket)}
+			handler := rateLimit(okHandler)
+			for i := 0; i < tt.requests; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.key != nil {
+					req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, tt.key))
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != tt.wantCodes[i] {
+					t.Fatalf("request %d: status = %d, want %d", i, rec.Code, tt.wantCodes[i])
+				}
+				if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: 429 without Retry-After", i)
+				}
+			}
+		})
+	}
+}
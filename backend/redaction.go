@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Log redaction ---
+//
+// User content (prompts, model output and upstream response bodies) is only logged through
+// contentAttr, and LOG_CONTENT decides how much of it reaches the logs:
+//
+//	none      content attributes are left out entirely
+//	metadata  only the length and a keyed hash, so repeated content can be correlated (default)
+//	full      the text, truncated to LOG_CONTENT_MAX_CHARS
+//
+// Whatever the mode, redactingHandler masks e-mail addresses, phone and card numbers and API
+// keys in every message and string attribute, including error messages. Files that keep content
+// outside the logs (feedback decisions, shadow results) follow the same mode through storedContent.
+
+// Content logging modes accepted in LOG_CONTENT.
+const (
+	logContentNone     = "none"
+	logContentMetadata = "metadata"
+	logContentFull     = "full"
+)
+
+// contentLogConfig holds the content logging settings.
+type contentLogConfig struct {
+	Mode     string
+	MaxChars int
+	HashKey  []byte // Keys the content hash; random per process unless LOG_CONTENT_HASH_KEY is set
+}
+
+var contentLogSettings = contentLogConfig{Mode: logContentMetadata, MaxChars: 200}
+
+// Attributes holding identifiers, which are never rewritten by the PII patterns.
+var unredactedLogKeys = map[string]bool{"request_id": true, "trace_id": true, "conversation_id": true}
+
+var (
+	secretPattern = regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}|(?i:bearer)\s+[A-Za-z0-9._~+/=-]{16,}`)
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardPattern   = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	phonePattern  = regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?\(?\d{2,4}\)?[\s.-]\d{3,4}[\s.-]\d{3,4}\b`)
+)
+
+// initContentLogging reads LOG_CONTENT, LOG_CONTENT_MAX_CHARS and LOG_CONTENT_HASH_KEY.
+func initContentLogging() error {
+	cfg := contentLogSettings
+	switch cfg.Mode = strings.ToLower(envString("LOG_CONTENT", cfg.Mode)); cfg.Mode {
+	case logContentNone, logContentMetadata, logContentFull:
+	default:
+		return fmt.Errorf("invalid LOG_CONTENT %q, expected none, metadata or full", cfg.Mode)
+	}
+	cfg.MaxChars = envInt("LOG_CONTENT_MAX_CHARS", cfg.MaxChars)
+	if cfg.MaxChars < 1 {
+		return fmt.Errorf("LOG_CONTENT_MAX_CHARS must be positive")
+	}
+	if key := envString("LOG_CONTENT_HASH_KEY", ""); key != "" {
+		cfg.HashKey = []byte(key)
+	} else {
+		cfg.HashKey = make([]byte, 32)
+		rand.Read(cfg.HashKey)
+	}
+	contentLogSettings = cfg
+	return nil
+}
+
+// loggedContent is user content in a log line, rendered according to the content logging mode.
+type loggedContent string
+
+// contentAttr is the only way user content should be logged.
+func contentAttr(key, text string) slog.Attr {
+	return slog.Any(key, loggedContent(text))
+}
+
+func (c loggedContent) LogValue() slog.Value {
+	text := string(c)
+	switch contentLogSettings.Mode {
+	case logContentFull:
+		text = redactPII(text) // Before truncating, so a cut can't leave part of a match behind
+		if n := utf8.RuneCountInString(text); n > contentLogSettings.MaxChars {
+			text = string([]rune(text)[:contentLogSettings.MaxChars]) + fmt.Sprintf("…(%d more chars)", n-contentLogSettings.MaxChars)
+		}
+		return slog.StringValue(text)
+	case logContentMetadata:
+		return slog.GroupValue(slog.Int("chars", utf8.RuneCountInString(text)), slog.String("hash", contentHash(text)))
+	default:
+		return slog.GroupValue() // Empty groups are omitted by the handlers
+	}
+}
+
+// storedContent applies the content logging mode to user content written to files other than the
+// logs: the text (PII-redacted, but not truncated) only in full mode, and the keyed hash in full
+// and metadata mode.
+func storedContent(text string) (stored, hash string) {
+	if text == "" {
+		return "", ""
+	}
+	switch contentLogSettings.Mode {
+	case logContentFull:
+		return redactPII(text), contentHash(text)
+	case logContentMetadata:
+		return "", contentHash(text)
+	default:
+		return "", ""
+	}
+}
+
+// contentHash returns a short keyed hash of user content, so repeated content can be matched
+// across log lines and audit records without storing it. Hashes are only comparable across
+// restarts if LOG_CONTENT_HASH_KEY is set.
+func contentHash(text string) string {
+	mac := hmac.New(sha256.New, contentLogSettings.HashKey)
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// redactPII masks secrets, e-mail addresses, card numbers (passing the Luhn check) and phone
+// numbers in s.
+func redactPII(s string) string {
+	s = secretPattern.ReplaceAllString(s, "[secret]")
+	s = emailPattern.ReplaceAllString(s, "[email]")
+	s = cardPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if luhnValid(match) {
+			return "[card]"
+		}
+		return match
+	})
+	return replaceMatchesFunc(phonePattern, s, func(match string, start, end int) string {
+		// Dotted quads and version strings (192.168.100.1, 10.200.3000.4) are runs of dot-separated
+		// numbers; a phone number isn't glued to further digits or dots
+		if start > 0 && (s[start-1] == '.' || isDigit(s[start-1])) {
+			return match
+		}
+		if end < len(s) && (isDigit(s[end]) || s[end] == '.' && end+1 < len(s) && isDigit(s[end+1])) {
+			return match
+		}
+		return "[phone]"
+	})
+}
+
+// replaceMatchesFunc is regexp.ReplaceAllStringFunc with the match's position in s.
+func replaceMatchesFunc(re *regexp.Regexp, s string, repl func(match string, start, end int) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(s, -1) {
+		b.WriteString(s[last:loc[0]])
+		b.WriteString(repl(s[loc[0]:loc[1]], loc[0], loc[1]))
+		last = loc[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by card numbers.
+func luhnValid(s string) bool {
+	var sum, count int
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if count%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		count++
+	}
+	return count >= 13 && sum%10 == 0
+}
+
+// redactingHandler applies redactPII to every record before passing it on.
+type redactingHandler struct {
+	inner slog.Handler
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redactPII(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return redactingHandler{inner: h.inner.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{inner: h.inner.WithGroup(name)}
+}
+
+// redactAttr resolves content attributes and masks PII in string values and errors.
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if !unredactedLogKeys[a.Key] {
+			a.Value = slog.StringValue(redactPII(a.Value.String()))
+		}
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redacted[i] = redactAttr(member)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactPII(err.Error()))
+		}
+	}
+	return a
+}
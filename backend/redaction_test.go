@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withContentMode(t *testing.T, mode string) {
+	t.Helper()
+	previous := contentLogSettings
+	contentLogSettings = contentLogConfig{Mode: mode, MaxChars: 200, HashKey: []byte("test-key")}
+	t.Cleanup(func() { contentLogSettings = previous })
+}
+
+func TestChatPromptNotLoggedWithContentNone(t *testing.T) {
+	const prompt = "my secret plan involves the purple giraffe"
+	const reply = "the giraffe reply text"
+	handler := setupTestRouter(t)
+	stub := newStubOpenRouter(t, reply)
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			withContentMode(t, logContentNone)
+			logs := captureLogs(t)
+			body := fmt.Sprintf(`{"model":"x-ai/grok-3-mini-beta","stream":%v,"messages":[{"role":"user","content":%q}]}`, stream, prompt)
+			rec := postJSON(handler, "/api/chat", body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), "reply") {
+				t.Fatalf("response doesn't contain the stub's reply: %s", rec.Body)
+			}
+			sent := stub.received()
+			if len(sent) == 0 || sent[len(sent)-1].Messages[0].Content != prompt {
+				t.Fatalf("the prompt didn't reach the upstream stub")
+			}
+
+			out := logs.String()
+			if !strings.Contains(out, "Received request") {
+				t.Fatalf("request wasn't logged:\n%s", out)
+			}
+			for _, leaked := range []string{prompt, "purple giraffe", reply} {
+				if strings.Contains(out, leaked) {
+					t.Errorf("logs contain %q:\n%s", leaked, out)
+				}
+			}
+		})
+	}
+}
+
+func TestChatPromptLoggedWithContentFull(t *testing.T) {
+	// Guards the test above: the same capture does see the prompt when content logging is on
+	handler := setupTestRouter(t)
+	newStubOpenRouter(t, "ok")
+	withContentMode(t, logContentFull)
+	logs := captureLogs(t)
+	postJSON(handler, "/api/chat", `{"model":"x-ai/grok-3-mini-beta","messages":[{"role":"user","content":"the purple giraffe"}]}`)
+	if !strings.Contains(logs.String(), "the purple giraffe") {
+		t.Fatalf("prompt not logged in full mode:\n%s", logs)
+	}
+}
+
+func TestStoredContent(t *testing.T) {
+	tests := []struct {
+		mode             string
+		wantText, wantID bool
+	}{
+		{logContentNone, false, false},
+		{logContentMetadata, false, true},
+		{logContentFull, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			withContentMode(t, tt.mode)
+			text, hash := storedContent("mail me at jane@example.com")
+			if (text != "") != tt.wantText || (hash != "") != tt.wantID {
+				t.Fatalf("storedContent = %q, %q", text, hash)
+			}
+			if strings.Contains(text, "jane@example.com") {
+				t.Errorf("stored text isn't redacted: %q", text)
+			}
+		})
+	}
+}
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"call +1 555-123-4567 today", "call [phone] today"},
+		{"call 555.123.4567", "call [phone]"},
+		{"write to jane.doe@example.com", "write to [email]"},
+		{"card 4111 1111 1111 1111 ok", "card [card] ok"},
+		{"order 1234567890123456", "order 1234567890123456"}, // Fails the Luhn check
+		{"key sk-abcdefghijklmnop1234", "key [secret]"},
+		{"server at 192.168.100.1 is down", "server at 192.168.100.1 is down"},
+		{"connect to 10.200.3000.40", "connect to 10.200.3000.40"},
+		{"version 12.345.6789.1 released", "version 12.345.6789.1 released"},
+	}
+	for _, tt := range tests {
+		if got := redactPII(tt.in); got != tt.want {
+			t.Errorf("redactPII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
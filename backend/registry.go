@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Model registry ---
+//
+// The registry knows each model's context length, modalities, tool/structured-output support and
+// price. It is built from, in increasing precedence: the embedded models.json, the OpenRouter
+// models API (MODEL_REGISTRY_SYNC=true, cached in MODEL_REGISTRY_CACHE), and MODEL_REGISTRY_FILE.
+
+//go:embed models.json
+var defaultModelsJSON []byte
+
+const openrouterModelsURL = "https://openrouter.ai/api/v1/models"
+
+// onlineSuffix is OpenRouter's web-search variant suffix, valid for any model.
+const onlineSuffix = ":online"
+
+// knownModalities are the input modalities a registry entry may list.
+var knownModalities = map[string]bool{"text": true, "image": true, "file": true, "audio": true, "video": true}
+
+// modelPricing is in USD per million tokens.
+type modelPricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+	Request    float64 `json:"request,omitempty"` // Flat USD per request
+}
+
+// modelInfo describes one model in the registry.
+type modelInfo struct {
+	ID                       string       `json:"id"`
+	Name                     string       `json:"name,omitempty"`
+	ContextLength            int          `json:"context_length"`
+	MaxCompletionTokens      int          `json:"max_completion_tokens,omitempty"`
+	InputModalities          []string     `json:"input_modalities,omitempty"`
+	SupportsTools            bool         `json:"supports_tools"`
+	SupportsStructuredOutput bool         `json:"supports_structured_output"`
+	SupportsReasoning        bool         `json:"supports_reasoning,omitempty"`
+	Pricing                  modelPricing `json:"pricing"`
+}
+
+// modelRegistry is a concurrency-safe set of models keyed by ID.
+type modelRegistry struct {
+	mu       sync.RWMutex
+	models   map[string]modelInfo
+	strict   bool // Reject direct requests for models not in the registry
+	syncedAt time.Time
+}
+
+var (
+	models = &modelRegistry{models: make(map[string]modelInfo), strict: true}
+	// modelOverrides from MODEL_REGISTRY_FILE are re-applied after every OpenRouter sync.
+	modelOverrides []modelInfo
+)
+
+// initModelRegistry builds the registry and starts the background OpenRouter sync if enabled.
+func initModelRegistry() error {
+	defaults, err := parseModels(defaultModelsJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse embedded models.json: %w", err)
+	}
+	models.merge(defaults)
+
+	if path := envString("MODEL_REGISTRY_FILE", ""); path != "" {
+		overrides, err := readModelsFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load model registry file: %w", err)
+		}
+		modelOverrides = overrides
+	}
+
+	if envBool("MODEL_REGISTRY_SYNC", false) {
+		cachePath := envString("MODEL_REGISTRY_CACHE", "models_cache.json")
+		if err := syncModelsFromOpenRouter(cachePath); err != nil {
+			slog.Warn("OpenRouter model sync failed, using cache", "path", cachePath, "error", err)
+			if cached, err := readModelsFile(cachePath); err == nil {
+				models.merge(cached)
+			} else if !os.IsNotExist(err) {
+				slog.Warn("Failed to read model cache", "path", cachePath, "error", err)
+			}
+		}
+		if interval := envDuration("MODEL_REGISTRY_SYNC_INTERVAL", 24*time.Hour); interval > 0 {
+			go func() {
+				for range time.Tick(interval) {
+					if err := syncModelsFromOpenRouter(cachePath); err != nil {
+						slog.Warn("Periodic OpenRouter model sync failed", "error", err)
+					}
+				}
+			}()
+		}
+	}
+
+	models.merge(modelOverrides)
+
+	models.strict = envBool("MODEL_REGISTRY_STRICT", true)
+	slog.Info("Model registry loaded", "models", models.Len(), "strict", models.strict)
+	return nil
+}
+
+// readModelsFile reads a JSON array of modelInfo.
+func readModelsFile(path string) ([]modelInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseModels(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+// parseModels decodes and validates a JSON array of modelInfo. Unknown fields (such as a
+// misspelled capability), duplicate or missing IDs, negative limits and unknown input modalities
+// are errors, so a mistake in a registry file doesn't silently disable a capability.
+func parseModels(data []byte) ([]modelInfo, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var list []modelInfo
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(list))
+	for i, m := range list {
+		switch {
+		case m.ID == "":
+			return nil, fmt.Errorf("model #%d has no id", i+1)
+		case seen[m.ID]:
+			return nil, fmt.Errorf("model %s is listed twice", m.ID)
+		case m.ContextLength < 0 || m.MaxCompletionTokens < 0:
+			return nil, fmt.Errorf("model %s has a negative token limit", m.ID)
+		case m.Pricing.Prompt < 0 || m.Pricing.Completion < 0 || m.Pricing.Request < 0:
+			return nil, fmt.Errorf("model %s has a negative price", m.ID)
+		}
+		for _, modality := range m.InputModalities {
+			if !knownModalities[modality] {
+				return nil, fmt.Errorf("model %s has unknown input modality %q", m.ID, modality)
+			}
+		}
+		seen[m.ID] = true
+	}
+	return list, nil
+}
+
+// merge adds or replaces models.
+func (r *modelRegistry) merge(list []modelInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range list {
+		if m.ID != "" {
+			r.models[m.ID] = m
+		}
+	}
+}
+
+// Len returns the number of models.
+func (r *modelRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.models)
+}
+
+// Lookup returns the model for an ID. The ":online" variant of a known model resolves to the base
+// model's entry, with the suffixed ID.
+func (r *modelRegistry) Lookup(id string) (modelInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m, ok := r.models[id]; ok {
+		return m, true
+	}
+	if base := strings.TrimSuffix(id, onlineSuffix); base != id {
+		if m, ok := r.models[base]; ok {
+			m.ID = id
+			return m, true
+		}
+	}
+	return modelInfo{}, false
+}
+
+// List returns all models sorted by ID.
+func (r *modelRegistry) List() []modelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]modelInfo, 0, len(r.models))
+	for _, m := range r.models {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Validate checks a directly requested model against the registry.
+func (r *modelRegistry) Validate(id string) error {
+	if _, ok := r.Lookup(id); ok || !r.strict {
+		return nil
+	}
+	return fmt.Errorf("unknown model %q", id)
+}
+
+// estimateCostUSD returns the price of a request with the given token counts, and false if
+// the model has no pricing information.
+func estimateCostUSD(model string, promptTokens, completionTokens int) (float64, bool) {
+	info, ok := models.Lookup(model)
+	if !ok {
+		return 0, false
+	}
+	p := info.Pricing
+	return p.Request + (float64(promptTokens)*p.Prompt+float64(completionTokens)*p.Completion)/1e6, true
+}
+
+// openRouterModel is the subset of the OpenRouter models API we use. Prices are USD per token, as strings.
+type openRouterModel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ContextLength int    `json:"context_length"`
+	Architecture  struct {
+		InputModalities []string `json:"input_modalities"`
+	} `json:"architecture"`
+	Pricing struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+		Request    string `json:"request"`
+	} `json:"pricing"`
+	TopProvider struct {
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	} `json:"top_provider"`
+	SupportedParameters []string `json:"supported_parameters"`
+}
+
+// syncModelsFromOpenRouter fetches the OpenRouter model list, merges it and writes the cache file.
+func syncModelsFromOpenRouter(cachePath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openrouterModelsURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENROUTER_API_KEY"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OpenRouter models API returned status %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		Data []openRouterModel `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return fmt.Errorf("failed to decode OpenRouter models: %w", err)
+	}
+	list := make([]modelInfo, 0, len(payload.Data))
+	for _, m := range payload.Data {
+		list = append(list, m.toModelInfo())
+	}
+	models.merge(list)
+	models.merge(modelOverrides)
+	models.mu.Lock()
+	models.syncedAt = time.Now().UTC()
+	models.mu.Unlock()
+	slog.Info("Synced models from OpenRouter", "models", len(list))
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cachePath, data, 0o644); err != nil {
+		slog.Warn("Failed to write model cache", "path", cachePath, "error", err)
+	}
+	return nil
+}
+
+func (m openRouterModel) toModelInfo() modelInfo {
+	price := func(s string) float64 {
+		v, _ := strconv.ParseFloat(s, 64)
+		return v
+	}
+	info := modelInfo{
+		ID:                  m.ID,
+		Name:                m.Name,
+		ContextLength:       m.ContextLength,
+		MaxCompletionTokens: m.TopProvider.MaxCompletionTokens,
+		InputModalities:     m.Architecture.InputModalities,
+		Pricing: modelPricing{
+			Prompt:     price(m.Pricing.Prompt) * 1e6,
+			Completion: price(m.Pricing.Completion) * 1e6,
+			Request:    price(m.Pricing.Request),
+		},
+	}
+	for _, param := range m.SupportedParameters {
+		switch param {
+		case "tools":
+			info.SupportsTools = true
+		case "structured_outputs", "response_format":
+			info.SupportsStructuredOutput = true
+		case "reasoning", "include_reasoning":
+			info.SupportsReasoning = true
+		}
+	}
+	return info
+}
+
+// modelsHandler serves GET /api/models.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{"models": models.List()}
+	models.mu.RLock()
+	if !models.syncedAt.IsZero() {
+		resp["synced_at"] = models.syncedAt
+	}
+	models.mu.RUnlock()
+	jsonResponse(w, resp)
+}
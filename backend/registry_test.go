@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseModels(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"valid", `[{"id":"a/x","context_length":8000,"input_modalities":["text","image"],"supports_tools":true,"pricing":{"prompt":1,"completion":2}}]`, ""},
+		{"not an array", `{"id":"a/x"}`, "cannot unmarshal"},
+		{"duplicate", `[{"id":"a/x"},{"id":"a/x"}]`, "listed twice"},
+		{"missing id", `[{"id":"a/x"},{"context_length":8000}]`, "model #2 has no id"},
+		{"unknown capability", `[{"id":"a/x","supports_tool":true}]`, "unknown field \"supports_tool\""},
+		{"unknown modality", `[{"id":"a/x","input_modalities":["text","smell"]}]`, "unknown input modality \"smell\""},
+		{"negative context", `[{"id":"a/x","context_length":-1}]`, "negative token limit"},
+		{"negative price", `[{"id":"a/x","pricing":{"prompt":-1}}]`, "negative price"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseModels([]byte(tt.json))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEmbeddedModelsAreValid(t *testing.T) {
+	if _, err := parseModels(defaultModelsJSON); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withModelRegistry runs initModelRegistry on an empty registry with MODEL_REGISTRY_FILE
+// holding overrides (if not empty) and MODEL_REGISTRY_STRICT set to strict.
+func withModelRegistry(t *testing.T, overrides, strict string) error {
+	t.Helper()
+	previous, previousOverrides := models, modelOverrides
+	t.Cleanup(func() { models, modelOverrides = previous, previousOverrides })
+	models, modelOverrides = &modelRegistry{models: make(map[string]modelInfo), strict: true}, nil
+	path := ""
+	if overrides != "" {
+		path = filepath.Join(t.TempDir(), "models.json")
+		if err := os.WriteFile(path, []byte(overrides), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("MODEL_REGISTRY_FILE", path)
+	t.Setenv("MODEL_REGISTRY_STRICT", strict)
+	t.Setenv("MODEL_REGISTRY_SYNC", "false")
+	return initModelRegistry()
+}
+
+func TestInitModelRegistry(t *testing.T) {
+	t.Run("override file", func(t *testing.T) {
+		if err := withModelRegistry(t, `[{"id":"local/model","context_length":4096},{"id":"openai/gpt-4o","context_length":1}]`, "true"); err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := models.Lookup("local/model"); !ok || m.ContextLength != 4096 {
+			t.Errorf("added model = %+v, %v", m, ok)
+		}
+		if m, _ := models.Lookup("openai/gpt-4o"); m.ContextLength != 1 {
+			t.Errorf("override not applied: %+v", m)
+		}
+	})
+	t.Run("invalid override file", func(t *testing.T) {
+		err := withModelRegistry(t, `[{"id":"a/x"},{"id":"a/x"}]`, "true")
+		if err == nil || !strings.Contains(err.Error(), "listed twice") {
+			t.Errorf("error = %v, want the duplicate reported", err)
+		}
+	})
+	t.Run("missing override file", func(t *testing.T) {
+		previous, previousOverrides := models, modelOverrides
+		t.Cleanup(func() { models, modelOverrides = previous, previousOverrides })
+		t.Setenv("MODEL_REGISTRY_FILE", filepath.Join(t.TempDir(), "nope.json"))
+		if err := initModelRegistry(); err == nil {
+			t.Error("missing MODEL_REGISTRY_FILE accepted")
+		}
+	})
+}
+
+func TestModelRegistryStrictMode(t *testing.T) {
+	tests := []struct {
+		strict  string
+		model   string
+		wantErr bool
+	}{
+		{"true", "openai/gpt-4o", false},
+		{"true", "openai/gpt-4o:online", false},
+		{"true", "made-up/model", true},
+		{"true", "made-up/model:online", true},
+		{"false", "made-up/model", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strict+" "+tt.model, func(t *testing.T) {
+			if err := withModelRegistry(t, "", tt.strict); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Validate(tt.model); (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) = %v, want error %v", tt.model, err, tt.wantErr)
+			}
+		})
+	}
+}
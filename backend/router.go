@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// --- Routing and middleware ---
+//
+// Every endpoint is an entry in routes. newRouter serves them behind a chain of middleware, so
+// handlers only contain their own logic. For every request:
+//
+//	requestIDMiddleware  assigns the request ID (see logging.go)
+//	corsMiddleware       applies the CORS policy and answers preflights (see cors.go)
+//	limitRequestBodies   caps request bodies (see server.go)
+//
+// and then per route, unless the route is Uninstrumented (only answerOptions and allowMethods
+// apply there):
+//
+//	answerOptions        200 to OPTIONS requests that aren't CORS preflights
+//	instrumentHandler    metrics, tracing and the audit log (see metrics.go)
+//	logRequests          one access log line per request
+//	recoverPanics        turns a panicking handler into a 500
+//	allowMethods         405 for methods the route doesn't serve
+//	requireAPIKey        403 without a valid API key, unless the route is Public (see apikeys.go)
+//	rateLimit            429 once the key's rate limit is used up (see ratelimit.go)
+
+// middleware wraps a handler with one stage of request processing.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in the middlewares, the first of which runs first.
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// route is one entry of the route table.
+type route struct {
+	Pattern        string // http.ServeMux pattern; also the route label in metrics and the audit log
+	Methods        []string
+	Public         bool // Served without an API key or rate limit
+	Uninstrumented bool // Not counted, traced, audited or logged, for scrapes and probes
+	Handler        http.HandlerFunc
+}
+
+var routes = []route{
+	{Pattern: "/api/chat", Methods: []string{http.MethodPost}, Handler: chatHandler},
+	{Pattern: "/api/compare", Methods: []string{http.MethodPost}, Handler: compareHandler},
+	{Pattern: "/api/models", Methods: []string{http.MethodGet}, Handler: modelsHandler},
+	{Pattern: "/api/tokenize", Methods: []string{http.MethodPost}, Handler: tokenizeHandler},
+	{Pattern: "/api/feedback", Methods: []string{http.MethodPost}, Handler: feedbackHandler},
+	{Pattern: "/api/conversations", Methods: []string{http.MethodGet, http.MethodPost}, Handler: conversationsHandler},
+	{Pattern: "/api/conversations/", Methods: []string{http.MethodGet, http.MethodDelete}, Handler: conversationsHandler},
+	{Pattern: "/api/experiments", Methods: []string{http.MethodGet}, Handler: experimentsHandler},
+	{Pattern: "/api/classifier/cache", Methods: []string{http.MethodGet}, Handler: classificationCacheHandler},
+	{Pattern: "/metrics", Methods: []string{http.MethodGet}, Public: true, Uninstrumented: true, Handler: metricsHandler},
+	{Pattern: "/healthz", Methods: []string{http.MethodGet, http.MethodHead}, Public: true, Uninstrumented: true, Handler: healthzHandler},
+	{Pattern: "/readyz", Methods: []string{http.MethodGet, http.MethodHead}, Public: true, Uninstrumented: true, Handler: readyzHandler},
+}
+
+// newRouter builds the server's handler from the route table.
+func newRouter(routes []route) http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.Handle(rt.Pattern, rt.handler())
+	}
+	return chain(mux, requestIDMiddleware, corsMiddleware, limitRequestBodies)
+}
+
+// handler wraps the route's handler in its middleware.
+func (rt route) handler() http.Handler {
+	if rt.Uninstrumented {
+		return chain(rt.Handler, answerOptions(rt.Methods), allowMethods(rt.Methods))
+	}
+	stages := []middleware{logRequests(rt.Pattern), recoverPanics, allowMethods(rt.Methods)}
+	if !rt.Public {
+		stages = append(stages, requireAPIKey, rateLimit)
+	}
+	return answerOptions(rt.Methods)(instrumentHandler(rt.Pattern, chain(rt.Handler, stages...).ServeHTTP))
+}
+
+// answerOptions answers plain OPTIONS requests with 200 and the allowed methods, as the handlers
+// did before routing moved here; load balancer health checks send OPTIONS /api/chat. Preflights
+// never get here, corsMiddleware answers them.
+func answerOptions(methods []string) middleware {
+	allowed := strings.Join(append(append([]string(nil), methods...), http.MethodOptions), ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Allow", allowed)
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+}
+
+// allowMethods answers 405 to requests whose method isn't one of methods.
+func allowMethods(methods []string) middleware {
+	allowed := strings.Join(methods, ", ")
+	message := "Method Not Allowed: Only " + joinWithOr(methods) + " requests are accepted"
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, m := range methods {
+				if r.Method == m {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Allow", allowed)
+			http.Error(w, message, http.StatusMethodNotAllowed)
+		})
+	}
+}
+
+// joinWithOr joins ["GET", "POST", "DELETE"] as "GET, POST or DELETE".
+func joinWithOr(items []string) string {
+	if len(items) < 2 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
+}
+
+// recoverPanics logs a panicking handler's panic with its stack and answers 500. Streams that
+// already started get an error event and [DONE] instead.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler { // Deliberate abort, which net/http handles quietly
+				panic(v)
+			}
+			logFor(r.Context()).Error("Recovered from panic in handler", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			metricPanics.add(1)
+			switch {
+			case !responseStarted(w):
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			case strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream"):
+				sendErrorSSE(r.Context(), w, "Internal Server Error")
+				sendDoneSSE(r.Context(), w)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseStarted reports whether the response status has been written.
+func responseStarted(w http.ResponseWriter) bool {
+	rec, ok := w.(*statusRecorder)
+	return ok && rec.status != 0
+}
+
+// logRequests writes one access log line per request once it completes.
+func logRequests(route string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			next.ServeHTTP(w, r)
+			status := http.StatusOK
+			if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+				status = rec.status
+			}
+			logFor(r.Context()).Info("Request completed", "method", r.Method, "route", route, "path", r.URL.Path,
+				"status", status, "duration_ms", time.Since(started).Milliseconds())
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// okHandler answers 200 "ok".
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+func TestChain(t *testing.T) {
+	var order []string
+	stage := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	chain(okHandler, stage("a"), stage("b"), stage("c")).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := strings.Join(order, ","); got != "a,b,c" {
+		t.Fatalf("stages ran in order %s, want a,b,c", got)
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		methods   []string
+		method    string
+		wantCode  int
+		wantAllow string
+		wantBody  string
+	}{
+		{"allowed", []string{http.MethodPost}, http.MethodPost, http.StatusOK, "", "ok"},
+		{"one method", []string{http.MethodPost}, http.MethodGet, http.StatusMethodNotAllowed, "POST", "Only POST requests are accepted"},
+		{"two methods", []string{http.MethodGet, http.MethodHead}, http.MethodDelete, http.StatusMethodNotAllowed, "GET, HEAD", "Only GET or HEAD requests"},
+		{"three methods", []string{http.MethodGet, http.MethodPost, http.MethodDelete}, http.MethodPut, http.StatusMethodNotAllowed, "GET, POST, DELETE", "Only GET, POST or DELETE requests"},
+		{"second of several", []string{http.MethodGet, http.MethodDelete}, http.MethodDelete, http.StatusOK, "", "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			allowMethods(tt.methods)(okHandler).ServeHTTP(rec, httptest.NewRequest(tt.method, "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAnswerOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		wantCode  int
+		wantAllow string
+		wantBody  string
+	}{
+		{"plain OPTIONS", http.MethodOptions, http.StatusOK, "POST, OPTIONS", ""},
+		{"other methods pass through", http.MethodPost, http.StatusOK, "", "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			answerOptions([]string{http.MethodPost})(okHandler).ServeHTTP(rec, httptest.NewRequest(tt.method, "/", nil))
+			if rec.Code != tt.wantCode || rec.Header().Get("Allow") != tt.wantAllow || rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d, Allow %q, body %q", rec.Code, rec.Header().Get("Allow"), rec.Body)
+			}
+		})
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantCode int
+		wantBody string
+	}{
+		{"no panic", okHandler, http.StatusOK, "ok"},
+		{"panic before writing", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}, http.StatusInternalServerError, "Internal Server Error"},
+		{"mustJSON panic", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(mustJSON(make(chan int)))
+		}, http.StatusInternalServerError, "Internal Server Error"},
+		{"panic during a stream", func(w http.ResponseWriter, r *http.Request) {
+			setupSSEHeaders(w)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("data: first\n\n"))
+			panic("boom")
+		}, http.StatusOK, "event: error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := httptest.NewRecorder()
+			// instrumentHandler provides the statusRecorder that tells recoverPanics whether the
+			// response has started
+			instrumentHandler("/test", recoverPanics(tt.handler).ServeHTTP)(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+			if panicked := tt.wantCode != http.StatusOK || tt.wantBody == "event: error"; panicked != strings.Contains(logs.String(), "Recovered from panic") {
+				t.Errorf("panic logged = %v, want %v", !panicked, panicked)
+			}
+		})
+	}
+}
+
+func TestRecoverPanicsRepanicsAbort(t *testing.T) {
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestRouterPlainOptions(t *testing.T) {
+	// Load balancer health checks send OPTIONS /api/chat without any CORS headers
+	handler := setupTestRouter(t)
+	for _, path := range []string{"/api/chat", "/api/models", "/healthz"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("OPTIONS %s = %d, want 200", path, rec.Code)
+		}
+	}
+}
+
+func TestRouterStageOrder(t *testing.T) {
+	handler := setupTestRouter(t)
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		auth     bool
+		wantCode int
+	}{
+		{"method checked before the API key", http.MethodGet, "/api/chat", false, http.StatusMethodNotAllowed},
+		{"missing API key", http.MethodGet, "/api/models", false, http.StatusForbidden},
+		{"authorized", http.MethodGet, "/api/models", true, http.StatusOK},
+		{"public route", http.MethodGet, "/healthz", false, http.StatusOK},
+		{"unknown path", http.MethodGet, "/api/nope", true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.auth {
+				req.Header.Set(authHeaderKey, authHeaderValue)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if rec.Header().Get(requestIDHeader) == "" {
+				t.Errorf("response has no %s header", requestIDHeader)
+			}
+		})
+	}
+}
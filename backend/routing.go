@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Capability-aware routing ---
+//
+// In auto mode each category has an ordered list of models: its Model followed by its Candidates.
+// Those whose registry entry supports everything the request needs, and that fit the request's
+// max_cost_per_request, are ranked by its routing preference. A request too large for every
+// candidate goes to the best otherwise capable one and is trimmed by context management.
+
+// Capability names used in routing explanations.
+const (
+	capabilityImageInput       = "image_input"
+	capabilityFileInput        = "file_input"
+	capabilityTools            = "tools"
+	capabilityStructuredOutput = "structured_output"
+)
+
+// Routing preferences accepted in the request's "routing" object.
+const (
+	routingPreferenceQuality = "quality" // Configured candidate order
+	routingPreferenceCost    = "cost"    // Lowest estimated cost
+	routingPreferenceLatency = "latency" // Lowest observed time to first token, exploring unsampled candidates
+)
+
+var (
+	// errNoCapableModel is returned when no candidate of a category supports the request.
+	errNoCapableModel = errors.New("no candidate model supports the request")
+	// errNoAffordableModel is returned when every capable candidate exceeds max_cost_per_request.
+	errNoAffordableModel = errors.New("no candidate model within max_cost_per_request")
+	// errNoPermittedModel is returned when the API key may use none of the candidates.
+	errNoPermittedModel = errors.New("no candidate model permitted for the API key")
+)
+
+// routingOptions is the request's optional "routing" object. It only affects auto mode.
+type routingOptions struct {
+	Preference        string  `json:"preference,omitempty"`           // quality (default), cost or latency
+	MaxCostPerRequest float64 `json:"max_cost_per_request,omitempty"` // USD, estimated from registry pricing
+}
+
+// validate checks the preference and cost limit.
+func (o routingOptions) validate() error {
+	switch o.Preference {
+	case "", routingPreferenceQuality, routingPreferenceCost, routingPreferenceLatency:
+	default:
+		return fmt.Errorf("unknown routing preference %q (expected quality, cost or latency)", o.Preference)
+	}
+	if o.MaxCostPerRequest < 0 {
+		return fmt.Errorf("max_cost_per_request must not be negative")
+	}
+	return nil
+}
+
+// routingConfig holds the routing defaults.
+type routingConfig struct {
+	DefaultPreference        string
+	ExpectedCompletionTokens int     // Assumed reply length for cost estimates
+	LatencyExploration       float64 // Share of latency-routed requests sent to a candidate without samples
+}
+
+var routingSettings = routingConfig{
+	DefaultPreference:        routingPreferenceQuality,
+	ExpectedCompletionTokens: 500,
+	LatencyExploration:       0.05,
+}
+
+// initRouting reads ROUTING_DEFAULT_PREFERENCE, ROUTING_EXPECTED_COMPLETION_TOKENS and
+// ROUTING_LATENCY_EXPLORATION.
+func initRouting() error {
+	cfg := routingSettings
+	cfg.DefaultPreference = strings.ToLower(envString("ROUTING_DEFAULT_PREFERENCE", cfg.DefaultPreference))
+	if err := (routingOptions{Preference: cfg.DefaultPreference}).validate(); err != nil {
+		return fmt.Errorf("ROUTING_DEFAULT_PREFERENCE: %w", err)
+	}
+	cfg.ExpectedCompletionTokens = envInt("ROUTING_EXPECTED_COMPLETION_TOKENS", cfg.ExpectedCompletionTokens)
+	cfg.LatencyExploration = envFloat("ROUTING_LATENCY_EXPLORATION", cfg.LatencyExploration)
+	if cfg.LatencyExploration < 0 || cfg.LatencyExploration > 1 {
+		return fmt.Errorf("ROUTING_LATENCY_EXPLORATION must be between 0 and 1")
+	}
+	routingSettings = cfg
+	slog.Info("Routing configured", "default_preference", cfg.DefaultPreference, "expected_completion_tokens", cfg.ExpectedCompletionTokens,
+		"latency_exploration", cfg.LatencyExploration)
+	return nil
+}
+
+// routeRequirements are the capabilities a request needs, derived from its content.
+type routeRequirements struct {
+	Capabilities []string
+	Messages     []chatMessage // Counted with each candidate's tokenizer for the context check
+	Key          *apiKey       // Candidates must pass the key's model restrictions; nil allows all
+}
+
+// candidateVerdict records why a candidate was or wasn't chosen.
+type candidateVerdict struct {
+	Model            string   `json:"model"`
+	Rejected         string   `json:"rejected,omitempty"`
+	EstimatedCostUSD *float64 `json:"estimated_cost_usd,omitempty"`
+	LatencyMS        int64    `json:"observed_latency_ms,omitempty"`
+}
+
+// routeExplanation is reported as "routing" in the metadata event.
+type routeExplanation struct {
+	Required   []string           `json:"required_capabilities"`
+	Preference string             `json:"preference"`
+	MaxCostUSD float64            `json:"max_cost_per_request,omitempty"`
+	Candidates []candidateVerdict `json:"candidates"`
+	Selected   string             `json:"selected_model"`
+	Reason     string             `json:"reason"`
+}
+
+// requirementsFor derives the capabilities needed by a request.
+func requirementsFor(req completionRequest) routeRequirements {
+	rr := routeRequirements{Capabilities: []string{}, Messages: req.Messages}
+	var images, files, tools bool
+	for _, msg := range req.Messages {
+		for _, partType := range msg.partTypes() {
+			switch partType {
+			case "image_url", "image":
+				images = true
+			case "file":
+				files = true
+			}
+		}
+		if len(msg.ToolCalls) > 0 || msg.Role == "tool" {
+			tools = true
+		}
+	}
+	if hasJSONValue(req.Tools) {
+		tools = true
+	}
+	if images {
+		rr.Capabilities = append(rr.Capabilities, capabilityImageInput)
+	}
+	if files {
+		rr.Capabilities = append(rr.Capabilities, capabilityFileInput)
+	}
+	if tools {
+		rr.Capabilities = append(rr.Capabilities, capabilityTools)
+	}
+	if hasJSONValue(req.ResponseFormat) {
+		var format struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(req.ResponseFormat, &format) == nil && format.Type != "" && format.Type != "text" {
+			rr.Capabilities = append(rr.Capabilities, capabilityStructuredOutput)
+		}
+	}
+	return rr
+}
+
+// hasJSONValue reports whether a pass-through field holds something other than null or [].
+func hasJSONValue(raw json.RawMessage) bool {
+	s := strings.TrimSpace(string(raw))
+	return s != "" && s != "null" && s != "[]"
+}
+
+// capabilityGap returns why the model can't serve the requirements, or "" if it can.
+func capabilityGap(model string, rr routeRequirements) string {
+	if len(rr.Capabilities) == 0 {
+		return ""
+	}
+	info, ok := models.Lookup(model)
+	if !ok {
+		return "not in model registry, capabilities unknown"
+	}
+	var missing []string
+	for _, capability := range rr.Capabilities {
+		var supported bool
+		switch capability {
+		case capabilityImageInput:
+			supported = hasModality(info, "image")
+		case capabilityFileInput:
+			supported = hasModality(info, "file")
+		case capabilityTools:
+			supported = info.SupportsTools
+		case capabilityStructuredOutput:
+			supported = info.SupportsStructuredOutput
+		}
+		if !supported {
+			missing = append(missing, capability)
+		}
+	}
+	if len(missing) > 0 {
+		return "missing " + strings.Join(missing, ", ")
+	}
+	return ""
+}
+
+func hasModality(info modelInfo, modality string) bool {
+	for _, m := range info.InputModalities {
+		if m == modality {
+			return true
+		}
+	}
+	return false
+}
+
+// routeCategory picks the model for a category from its route (the classificationMap entry or an
+// experiment's override), explaining the choice. Candidates the API key may not use are skipped,
+// as for direct requests. Candidates meeting the requirements and the cost limit are ordered by
+// the preference; "quality" keeps the configured order.
+func routeCategory(ctx context.Context, category string, route categoryRoute, rr routeRequirements, opts routingOptions) (routeExplanation, error) {
+	if opts.Preference == "" {
+		opts.Preference = routingSettings.DefaultPreference
+	}
+	explanation := routeExplanation{Required: rr.Capabilities, Preference: opts.Preference, MaxCostUSD: opts.MaxCostPerRequest}
+
+	var eligible, tooLarge, tooExpensive []int // Indexes into explanation.Candidates
+	permitted := 0
+	for _, model := range append([]string{route.Model}, route.Candidates...) {
+		verdict := candidateVerdict{Model: model}
+		if rr.Key != nil && !rr.Key.modelAllowed(model) {
+			verdict.Rejected = "not permitted for this API key"
+			explanation.Candidates = append(explanation.Candidates, verdict)
+			continue
+		}
+		permitted++
+		verdict.Rejected = capabilityGap(model, rr)
+		if stat, ok := modelLatencies.get(model); ok {
+			verdict.LatencyMS = stat.EWMA.Milliseconds()
+		}
+		idx := len(explanation.Candidates)
+		if verdict.Rejected == "" {
+			tokens, _ := countMessagesTokens(model, rr.Messages)
+			budget := contextBudgetTokens(model)
+			if tokens > budget {
+				verdict.Rejected = fmt.Sprintf("needs ~%d prompt tokens, context budget is %d", tokens, budget)
+				tokens = budget // What is sent after trimming
+			}
+			if cost, ok := estimateCostUSD(model, tokens, routingSettings.ExpectedCompletionTokens); ok {
+				verdict.EstimatedCostUSD = &cost
+			}
+			switch {
+			case opts.MaxCostPerRequest > 0 && verdict.EstimatedCostUSD == nil:
+				verdict.Rejected = "no pricing information for max_cost_per_request"
+				tooExpensive = append(tooExpensive, idx)
+			case opts.MaxCostPerRequest > 0 && *verdict.EstimatedCostUSD > opts.MaxCostPerRequest:
+				verdict.Rejected = fmt.Sprintf("estimated cost $%.6f exceeds max_cost_per_request", *verdict.EstimatedCostUSD)
+				tooExpensive = append(tooExpensive, idx)
+			case verdict.Rejected == "":
+				eligible = append(eligible, idx)
+			default:
+				tooLarge = append(tooLarge, idx)
+			}
+		}
+		explanation.Candidates = append(explanation.Candidates, verdict)
+	}
+
+	switch {
+	case len(eligible) > 0:
+		pick := explanation.preferred(eligible)
+		explanation.Selected = explanation.Candidates[pick].Model
+		if explore, ok := explanation.exploreLatency(eligible); ok {
+			explanation.Selected = explanation.Candidates[explore].Model
+			explanation.Reason = "exploring a candidate without latency samples"
+		} else if pick == 0 && opts.Preference == routingPreferenceQuality {
+			explanation.Reason = "category default model meets all requirements"
+		} else {
+			explanation.Reason = "best candidate meeting all requirements by " + opts.Preference
+		}
+	case len(tooLarge) > 0:
+		explanation.Selected = explanation.Candidates[explanation.preferred(tooLarge)].Model
+		explanation.Reason = "no candidate fits the whole conversation; using the best capable one by " + opts.Preference + " and trimming history"
+	case len(tooExpensive) > 0:
+		return explanation, fmt.Errorf("%w: category %s, max_cost_per_request %g", errNoAffordableModel, category, opts.MaxCostPerRequest)
+	case permitted == 0:
+		return explanation, fmt.Errorf("%w: category %s, api key %s", errNoPermittedModel, category, rr.Key.Name)
+	default:
+		return explanation, fmt.Errorf("%w: category %s, required %s", errNoCapableModel, category, strings.Join(rr.Capabilities, ", "))
+	}
+	if explanation.Selected != route.Model {
+		logFor(ctx).Info("Routed category away from its default model", "category", category, "model", explanation.Selected,
+			"default_model", route.Model, "required", rr.Capabilities, "preference", opts.Preference)
+	}
+	return explanation, nil
+}
+
+// preferred returns the best of the given candidate indexes for the explanation's preference.
+// Candidates without the data the preference needs (pricing, latency samples) sort last.
+func (e *routeExplanation) preferred(indexes []int) int {
+	best := indexes[0]
+	for _, idx := range indexes[1:] {
+		c, b := e.Candidates[idx], e.Candidates[best]
+		switch e.Preference {
+		case routingPreferenceCost:
+			if c.EstimatedCostUSD != nil && (b.EstimatedCostUSD == nil || *c.EstimatedCostUSD < *b.EstimatedCostUSD) {
+				best = idx
+			}
+		case routingPreferenceLatency:
+			if c.LatencyMS > 0 && (b.LatencyMS == 0 || c.LatencyMS < b.LatencyMS) {
+				best = idx
+			}
+		}
+	}
+	return best
+}
+
+// exploreLatency occasionally picks one of the given candidates that has no latency samples yet.
+// Samples only come from the models that serve streams, so without exploring, latency routing
+// would never move away from the first sampled candidate. It returns false unless the preference
+// is latency, at least one candidate has samples to compare against and the draw falls within
+// ROUTING_LATENCY_EXPLORATION.
+func (e *routeExplanation) exploreLatency(indexes []int) (int, bool) {
+	if e.Preference != routingPreferenceLatency {
+		return 0, false
+	}
+	var unsampled []int
+	for _, idx := range indexes {
+		if _, ok := modelLatencies.get(e.Candidates[idx].Model); !ok {
+			unsampled = append(unsampled, idx)
+		}
+	}
+	if len(unsampled) == 0 || len(unsampled) == len(indexes) || rand.Float64() >= routingSettings.LatencyExploration {
+		return 0, false
+	}
+	return unsampled[rand.Intn(len(unsampled))], true
+}
+
+// latencyStat is an exponentially weighted moving average of a model's time to first token.
+type latencyStat struct {
+	EWMA    time.Duration
+	Samples int
+}
+
+// latencyTracker records observed latencies per model for latency-preferring routing.
+type latencyTracker struct {
+	mu    sync.Mutex
+	stats map[string]latencyStat
+}
+
+var modelLatencies = &latencyTracker{stats: make(map[string]latencyStat)}
+
+// latencyEWMAWeight is the weight of a new sample in the moving average.
+const latencyEWMAWeight = 0.2
+
+// observe records the time until the first token of a user-facing stream. Non-streaming calls
+// (shadow traffic, summaries, the classifier fallback) aren't observed: their full generation
+// time isn't comparable and would make busy background models look slow.
+func (t *latencyTracker) observe(model string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stat := t.stats[model]
+	if stat.Samples == 0 {
+		stat.EWMA = d
+	} else {
+		stat.EWMA = time.Duration(latencyEWMAWeight*float64(d) + (1-latencyEWMAWeight)*float64(stat.EWMA))
+	}
+	stat.Samples++
+	t.stats[model] = stat
+}
+
+func (t *latencyTracker) get(model string) (latencyStat, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stat, ok := t.stats[model]
+	return stat, ok
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLatencyObservedOnlyForUserStreams(t *testing.T) {
+	previous := modelLatencies
+	t.Cleanup(func() { modelLatencies = previous })
+	handler := setupTestRouter(t)
+	newStubOpenRouter(t, "Sure thing.")
+	const model = "x-ai/grok-3-mini-beta"
+
+	// Background calls such as summaries and shadow traffic are not streamed
+	modelLatencies = &latencyTracker{stats: make(map[string]latencyStat)}
+	if _, err := getOpenRouterResponse(context.Background(), []chatMessage{{Role: "user", Content: "Summarize"}}, model); err != nil {
+		t.Fatal(err)
+	}
+	if stat, ok := modelLatencies.get(model); ok {
+		t.Errorf("non-streaming call recorded %d latency samples", stat.Samples)
+	}
+
+	rec := postJSON(handler, "/api/chat", `{"model":"`+model+`","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if stat, ok := modelLatencies.get(model); !ok || stat.Samples != 1 {
+		t.Errorf("stream recorded %+v, want one time-to-first-token sample", stat)
+	}
+}
+
+func TestRouteCategoryRespectsKeyRestrictions(t *testing.T) {
+	route := categoryRoute{Model: "openai/gpt-4.1", Candidates: []string{"anthropic/claude-sonnet-4", "google/gemini-2.0-flash-001"}}
+	rr := routeRequirements{Capabilities: []string{}, Messages: []chatMessage{{Role: "user", Content: "Hi"}}}
+	tests := []struct {
+		name         string
+		allow, deny  []string
+		wantSelected string
+		wantErr      error
+	}{
+		{"unrestricted key", nil, nil, "openai/gpt-4.1", nil},
+		{"default model denied", nil, []string{"openai/*"}, "anthropic/claude-sonnet-4", nil},
+		{"only the last candidate allowed", []string{"google/*"}, nil, "google/gemini-2.0-flash-001", nil},
+		{"no candidate allowed", []string{"x-ai/*"}, nil, "", errNoPermittedModel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr.Key = &apiKey{Name: "restricted", allowRe: compileModelGlobs(tt.allow), denyRe: compileModelGlobs(tt.deny)}
+			explanation, err := routeCategory(context.Background(), "1", route, rr, routingOptions{Preference: routingPreferenceQuality})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if explanation.Selected != tt.wantSelected {
+				t.Errorf("selected %q, want %q", explanation.Selected, tt.wantSelected)
+			}
+		})
+	}
+}
+
+func TestLatencyRoutingExploresUnsampledCandidates(t *testing.T) {
+	setupTestRouter(t)
+	previousLatencies, previousSettings := modelLatencies, routingSettings
+	t.Cleanup(func() { modelLatencies, routingSettings = previousLatencies, previousSettings })
+	modelLatencies = &latencyTracker{stats: make(map[string]latencyStat)}
+	routingSettings.LatencyExploration = 0.2
+
+	route := categoryRoute{Model: "anthropic/claude-sonnet-4", Candidates: []string{"openai/gpt-4.1", "google/gemini-2.5-pro-preview"}}
+	observed := map[string]time.Duration{
+		"anthropic/claude-sonnet-4":     900 * time.Millisecond,
+		"openai/gpt-4.1":                200 * time.Millisecond,
+		"google/gemini-2.5-pro-preview": 500 * time.Millisecond,
+	}
+	rr := routeRequirements{Capabilities: []string{}, Messages: []chatMessage{{Role: "user", Content: "Hi"}}}
+	opts := routingOptions{Preference: routingPreferenceLatency}
+
+	// Only the model that serves a request gets a sample, as in chatHandler
+	modelLatencies.observe(route.Model, observed[route.Model])
+	for i := 0; i < 200; i++ {
+		explanation, err := routeCategory(context.Background(), "8", route, rr, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modelLatencies.observe(explanation.Selected, observed[explanation.Selected])
+	}
+
+	routingSettings.LatencyExploration = 0
+	explanation, err := routeCategory(context.Background(), "8", route, rr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Selected != "openai/gpt-4.1" {
+		t.Errorf("selected %s after exploring, want the fastest candidate openai/gpt-4.1 (%+v)", explanation.Selected, explanation.Candidates)
+	}
+}
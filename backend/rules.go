@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// classificationRule is a cheap, deterministic check evaluated before the Ollama classifier.
+// All conditions that are set must hold for the rule to match:
+//   - Pattern: the (Go RE2) regular expression must match the prompt
+//   - Keywords: at least one keyword must appear as a whole word (case-insensitive); word
+//     boundaries are only enforced on word-character edges, so "c++" and ".net" still match
+//   - MinLength/MaxLength: the prompt length in characters must be within bounds (0 = unbounded)
+type classificationRule struct {
+	Name       string   `json:"name"`
+	Category   string   `json:"category"` // Key into classificationMap
+	Pattern    string   `json:"pattern,omitempty"`
+	Keywords   []string `json:"keywords,omitempty"`
+	MinLength  int      `json:"min_length,omitempty"`
+	MaxLength  int      `json:"max_length,omitempty"`
+	Confidence float64  `json:"confidence"` // 0..1, compared against ruleConfidenceThreshold
+
+	patternRe  *regexp.Regexp
+	keywordsRe *regexp.Regexp
+}
+
+// ruleMatch describes the rule that short-circuited classification.
+type ruleMatch struct {
+	Rule       string
+	Category   string
+	Confidence float64
+}
+
+// defaultClassificationRules cover prompts that are trivially classifiable.
+var defaultClassificationRules = []classificationRule{
+	{
+		Name:       "code_fence",
+		Category:   "8",
+		Pattern:    "```",
+		Confidence: 0.95,
+	},
+	{
+		Name:       "small_talk",
+		Category:   "10",
+		Pattern:    `(?i)^\W*(hi|hello|hey|yo|hiya|thanks|thank you|thx|ty|cheers|good (morning|afternoon|evening|night)|how are you( doing)?|what'?s up|bye|goodbye)\W*$`,
+		MaxLength:  40,
+		Confidence: 0.95,
+	},
+	{
+		Name:       "url",
+		Category:   "2",
+		Pattern:    `https?://\S+`,
+		Confidence: 0.9,
+	},
+	{
+		Name:       "time_sensitive",
+		Category:   "2",
+		Keywords:   []string{"breaking news", "latest news", "news today", "current price", "stock price", "exchange rate", "weather forecast", "weather in"},
+		Confidence: 0.9,
+	},
+}
+
+var (
+	// classificationRules is the active rule set, in evaluation order.
+	classificationRules []classificationRule
+	// ruleConfidenceThreshold is the minimum confidence a rule needs to skip the Ollama call.
+	ruleConfidenceThreshold = 0.9
+)
+
+// loadClassificationRules initialises the rule layer from the environment.
+// CLASSIFICATION_RULES_ENABLED=false disables it, CLASSIFICATION_RULES_FILE points to a JSON array
+// of rules replacing the defaults, and CLASSIFICATION_RULE_THRESHOLD overrides the confidence threshold.
+func loadClassificationRules() error {
+	ruleConfidenceThreshold = envFloat("CLASSIFICATION_RULE_THRESHOLD", ruleConfidenceThreshold)
+	if !envBool("CLASSIFICATION_RULES_ENABLED", true) {
+		classificationRules = nil
+		slog.Info("Rule-based pre-classification disabled")
+		return nil
+	}
+
+	rules := defaultClassificationRules
+	if path := envString("CLASSIFICATION_RULES_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read classification rules file: %w", err)
+		}
+		rules = nil
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("failed to parse classification rules file %s: %w", path, err)
+		}
+	}
+
+	compiled, err := compileClassificationRules(rules)
+	if err != nil {
+		return err
+	}
+	classificationRules = compiled
+	slog.Info("Loaded classification rules", "rules", len(compiled), "confidence_threshold", ruleConfidenceThreshold)
+	return nil
+}
+
+// compileClassificationRules validates the rules and compiles their patterns.
+func compileClassificationRules(rules []classificationRule) ([]classificationRule, error) {
+	compiled := make([]classificationRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		if _, ok := classificationMap[rule.Category]; !ok {
+			return nil, fmt.Errorf("classification rule %q: unknown category %q", rule.Name, rule.Category)
+		}
+		if rule.Pattern == "" && len(rule.Keywords) == 0 && rule.MinLength == 0 && rule.MaxLength == 0 {
+			return nil, fmt.Errorf("classification rule %q has no conditions", rule.Name)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("classification rule %q: invalid pattern: %w", rule.Name, err)
+			}
+			rule.patternRe = re
+		}
+		if len(rule.Keywords) > 0 {
+			quoted := make([]string, 0, len(rule.Keywords))
+			for _, kw := range rule.Keywords {
+				kw = strings.TrimSpace(kw)
+				if kw == "" {
+					return nil, fmt.Errorf("classification rule %q has an empty keyword", rule.Name)
+				}
+				quoted = append(quoted, keywordPattern(kw))
+			}
+			rule.keywordsRe = regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)`)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// keywordPattern quotes a keyword and anchors it with \b on the edges that are word characters.
+// A \b next to a symbol would require a word character on the other side, so "c++" could never
+// be followed by a space and ".net" could never start a sentence.
+func keywordPattern(keyword string) string {
+	pattern := regexp.QuoteMeta(keyword)
+	first, _ := utf8.DecodeRuneInString(keyword)
+	if isWordRune(first) {
+		pattern = `\b` + pattern
+	}
+	last, _ := utf8.DecodeLastRuneInString(keyword)
+	if isWordRune(last) {
+		pattern += `\b`
+	}
+	return pattern
+}
+
+// isWordRune reports whether r is a word character in the RE2 \b sense (ASCII letters, digits, _).
+func isWordRune(r rune) bool {
+	return r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// matches reports whether all of the rule's conditions hold for the prompt.
+func (rule classificationRule) matches(prompt string) bool {
+	length := utf8.RuneCountInString(prompt)
+	if rule.MinLength > 0 && length < rule.MinLength {
+		return false
+	}
+	if rule.MaxLength > 0 && length > rule.MaxLength {
+		return false
+	}
+	if rule.patternRe != nil && !rule.patternRe.MatchString(prompt) {
+		return false
+	}
+	if rule.keywordsRe != nil && !rule.keywordsRe.MatchString(prompt) {
+		return false
+	}
+	return true
+}
+
+// matchClassificationRule returns the first rule that matches the prompt with at least
+// ruleConfidenceThreshold confidence.
+func matchClassificationRule(userInput string) (ruleMatch, bool) {
+	return matchClassificationRuleAbove(userInput, ruleConfidenceThreshold)
+}
+
+// matchClassificationRuleAbove returns the first rule with at least the given confidence
+// that matches the prompt. Empty prompts are never matched.
+func matchClassificationRuleAbove(userInput string, threshold float64) (ruleMatch, bool) {
+	prompt := strings.TrimSpace(userInput)
+	if prompt == "" {
+		return ruleMatch{}, false
+	}
+	for _, rule := range classificationRules {
+		if rule.Confidence < threshold {
+			continue
+		}
+		if rule.matches(prompt) {
+			return ruleMatch{Rule: rule.Name, Category: rule.Category, Confidence: rule.Confidence}, true
+		}
+	}
+	return ruleMatch{}, false
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestKeywordRules(t *testing.T) {
+	rules, err := compileClassificationRules([]classificationRule{
+		{Name: "lang", Category: "8", Keywords: []string{"c++", ".net", "go"}, Confidence: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prompt string
+		want   bool
+	}{
+		{"how do templates work in c++", true},
+		{"c++ templates", true},
+		{"is .net still popular?", true},
+		{"port it to asp.net", true},
+		{"let's go", true},
+		{"a good idea", false},
+		{"golang", false},
+	}
+	for _, tt := range tests {
+		if got := rules[0].matches(tt.prompt); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestCompileClassificationRulesRejectsEmptyKeyword(t *testing.T) {
+	for _, keywords := range [][]string{{""}, {"news", "  "}} {
+		_, err := compileClassificationRules([]classificationRule{{Category: "2", Keywords: keywords, Confidence: 1}})
+		if err == nil {
+			t.Errorf("keywords %q compiled, want an error", keywords)
+		}
+	}
+}
+
+func TestDefaultTimeSensitiveRule(t *testing.T) {
+	rules, err := compileClassificationRules(defaultClassificationRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := classificationRules
+	classificationRules = rules
+	t.Cleanup(func() { classificationRules = previous })
+
+	tests := []struct {
+		prompt string
+		want   bool
+	}{
+		{"what's the weather in Zagreb", true},
+		{"any breaking news about the election?", true},
+		{"current price of bitcoin", true},
+		{"I feel tired today, any tips?", false},
+		{"write a poem about rainy weather", false},
+		{"what should I cook today", false},
+	}
+	for _, tt := range tests {
+		match, ok := matchClassificationRule(tt.prompt)
+		if got := ok && match.Rule == "time_sensitive"; got != tt.want {
+			t.Errorf("%q matched time_sensitive = %v, want %v", tt.prompt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- HTTP server configuration ---
+//
+// The server gets header, read, write and idle timeouts (SERVER_READ_HEADER_TIMEOUT,
+// SERVER_READ_TIMEOUT, SERVER_WRITE_TIMEOUT, SERVER_IDLE_TIMEOUT). SSE responses replace the
+// write timeout with SERVER_STREAM_TIMEOUT when they start (see setupSSEHeaders). Request bodies
+// are limited to SERVER_MAX_BODY_BYTES, answered with 413 beyond that. With TLS_CERT_FILE and
+// TLS_KEY_FILE set the server speaks TLS, reloading the certificate when the files change, and
+// offers HTTP/2; SERVER_H2C=true also allows HTTP/2 without TLS, for use behind a proxy.
+
+// serverConfig holds the HTTP server settings.
+type serverConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	StreamTimeout     time.Duration
+	IdleTimeout       time.Duration
+	MaxBodyBytes      int64
+	CertFile, KeyFile string
+	H2C               bool
+}
+
+var serverSettings = serverConfig{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      3 * time.Minute, // Covers non-streaming requests with all their retries
+	StreamTimeout:     15 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	MaxBodyBytes:      10 << 20, // Leaves room for base64-encoded images
+}
+
+// newServer builds the HTTP server from the environment.
+func newServer(handler http.Handler) (*http.Server, error) {
+	cfg := serverSettings
+	cfg.ReadHeaderTimeout = envDuration("SERVER_READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout)
+	cfg.ReadTimeout = envDuration("SERVER_READ_TIMEOUT", cfg.ReadTimeout)
+	cfg.WriteTimeout = envDuration("SERVER_WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.StreamTimeout = envDuration("SERVER_STREAM_TIMEOUT", cfg.StreamTimeout)
+	cfg.IdleTimeout = envDuration("SERVER_IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.MaxBodyBytes = int64(envInt("SERVER_MAX_BODY_BYTES", int(cfg.MaxBodyBytes)))
+	cfg.CertFile = envString("TLS_CERT_FILE", "")
+	cfg.KeyFile = envString("TLS_KEY_FILE", "")
+	cfg.H2C = envBool("SERVER_H2C", false)
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	serverSettings = cfg
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		Protocols:         protocols,
+	}
+	if cfg.CertFile != "" {
+		reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.getCertificate}
+	}
+	slog.Info("HTTP server configured", "tls", cfg.CertFile != "", "h2c", cfg.H2C, "max_body_bytes", cfg.MaxBodyBytes,
+		"read_timeout", cfg.ReadTimeout.String(), "write_timeout", cfg.WriteTimeout.String(), "stream_timeout", cfg.StreamTimeout.String())
+	return server, nil
+}
+
+// listenAndServe serves plain HTTP or, if configured, TLS. The certificate comes from TLSConfig.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// limitRequestBodies caps every request body at SERVER_MAX_BODY_BYTES.
+func limitRequestBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > serverSettings.MaxBodyBytes {
+			writeBodyTooLarge(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, serverSettings.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("Request Entity Too Large: Request body exceeds %d bytes", serverSettings.MaxBodyBytes), http.StatusRequestEntityTooLarge)
+}
+
+// decodeJSONBody decodes the request body into v, writing a 413 or 400 response on failure.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeBodyTooLarge(w)
+	} else {
+		http.Error(w, "Bad Request: Could not decode JSON payload: "+err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
+
+// extendDeadlinesForStream lifts the read deadline and replaces the write deadline with
+// SERVER_STREAM_TIMEOUT, so SSE responses outlast the timeouts meant for regular requests.
+func extendDeadlinesForStream(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to clear read deadline for stream", "error", err)
+	}
+	if err := rc.SetWriteDeadline(time.Now().Add(serverSettings.StreamTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to extend write deadline for stream", "error", err)
+	}
+}
+
+// certReloader serves the certificate from disk, reloading it when the files change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // Latest modification time of the two files when last loaded
+	checkedAt time.Time
+}
+
+// certCheckInterval limits how often handshakes stat the certificate files.
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return c, nil
+}
+
+// reload must be called with mu held, or before the reloader is shared.
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime, c.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getCertificate is the tls.Config hook. A failed reload keeps serving the previous certificate.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+	if modTime, err := c.latestModTime(); err == nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.reload(); err != nil {
+		slog.Warn("Failed to reload TLS certificate, keeping the previous one", "error", err)
+		return c.cert, nil
+	}
+	slog.Info("Reloaded TLS certificate", "cert_file", c.certFile)
+	return c.cert, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitRequestBodies(t *testing.T) {
+	previous := serverSettings
+	t.Cleanup(func() { serverSettings = previous })
+	serverSettings.MaxBodyBytes = 64
+
+	decode := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]interface{}
+		if decodeJSONBody(w, r, &v) {
+			w.Write([]byte("ok"))
+		}
+	})
+	small := `{"a":"b"}`
+	large := `{"a":"` + strings.Repeat("x", 100) + `"}`
+	tests := []struct {
+		name     string
+		body     string
+		chunked  bool
+		wantCode int
+	}{
+		{"within the limit", small, false, http.StatusOK},
+		{"declared length over the limit", large, false, http.StatusRequestEntityTooLarge},
+		{"chunked within the limit", small, true, http.StatusOK},
+		{"chunked over the limit", large, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body) // Hides the length, so the request has none
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/chat", body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			limitRequestBodies(decode).ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+// writeTestCert writes a new self-signed certificate and key with the given serial number.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() int64 {
+		t.Helper()
+		cert, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute) // Some filesystems only keep whole seconds
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := served(); got != 1 {
+		t.Errorf("served serial %d within certCheckInterval, want the loaded 1", got)
+	}
+
+	reloader.mu.Lock()
+	reloader.checkedAt = time.Now().Add(-certCheckInterval)
+	reloader.mu.Unlock()
+	if got := served(); got != 2 {
+		t.Errorf("served serial %d after certCheckInterval, want the rewritten 2", got)
+	}
+
+	// A broken file keeps the last good certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(certFile, evenLater, evenLater)
+	reloader.mu.Lock()
+	reloader.checkedAt = time.Now().Add(-certCheckInterval)
+	reloader.mu.Unlock()
+	if got := served(); got != 2 {
+		t.Errorf("served serial %d after a failed reload, want the previous 2", got)
+	}
+}
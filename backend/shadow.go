@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Shadow traffic ---
+//
+// For a sampled fraction of auto-routed requests, the same messages are sent non-streaming to a
+// category's shadow model once the user's response is complete. Both outputs are written to
+// SHADOW_FILE with latency and estimated cost, as text or hashes depending on LOG_CONTENT (see
+// storedContent). Shadow calls never touch the user's response and are dropped, not queued, when
+// SHADOW_CONCURRENCY calls are already running.
+
+// shadowConfig holds the shadow traffic settings.
+type shadowConfig struct {
+	Models      map[string]string // Category key -> shadow model
+	SampleRate  float64
+	Path        string
+	Concurrency int
+}
+
+var (
+	shadowSettings = shadowConfig{Models: map[string]string{}, SampleRate: 0.05, Path: "shadow.jsonl", Concurrency: 4}
+	shadowSlots    chan struct{}
+	shadowMu       sync.Mutex
+)
+
+// shadowOutput is one side of a shadow comparison.
+type shadowOutput struct {
+	Model            string   `json:"model"`
+	Output           string   `json:"output,omitempty"`      // Only kept with LOG_CONTENT=full (see storedContent)
+	OutputHash       string   `json:"output_hash,omitempty"` // Keyed hash, unless LOG_CONTENT=none
+	Error            string   `json:"error,omitempty"`
+	LatencyMS        int64    `json:"latency_ms"`
+	PromptTokens     int      `json:"estimated_prompt_tokens"`
+	CompletionTokens int      `json:"estimated_completion_tokens"`
+	CostUSD          *float64 `json:"estimated_cost_usd,omitempty"`
+}
+
+// shadowRecord is one line of the shadow file.
+type shadowRecord struct {
+	Timestamp  time.Time             `json:"timestamp"`
+	RequestID  string                `json:"request_id"`
+	Category   string                `json:"category"`
+	Stream     bool                  `json:"stream"` // Whether the primary response was streamed
+	Experiment *experimentAssignment `json:"experiment,omitempty"`
+	Primary    shadowOutput          `json:"primary"`
+	Shadow     shadowOutput          `json:"shadow"`
+}
+
+// initShadow reads SHADOW_MODELS ("category=model,..."), SHADOW_SAMPLE_RATE, SHADOW_FILE and
+// SHADOW_CONCURRENCY. Shadow traffic is off unless SHADOW_MODELS is set.
+func initShadow() error {
+	for _, mapping := range envList("SHADOW_MODELS", nil) {
+		category, model, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return fmt.Errorf("invalid SHADOW_MODELS entry %q, expected category=model", mapping)
+		}
+		if _, known := classificationMap[category]; !known {
+			return fmt.Errorf("SHADOW_MODELS: unknown category %q", category)
+		}
+		if err := models.Validate(model); err != nil {
+			return fmt.Errorf("SHADOW_MODELS: %w", err)
+		}
+		shadowSettings.Models[category] = model
+	}
+	if len(shadowSettings.Models) == 0 {
+		return nil
+	}
+	shadowSettings.SampleRate = envFloat("SHADOW_SAMPLE_RATE", shadowSettings.SampleRate)
+	shadowSettings.Path = envString("SHADOW_FILE", shadowSettings.Path)
+	shadowSettings.Concurrency = envInt("SHADOW_CONCURRENCY", shadowSettings.Concurrency)
+	if shadowSettings.Concurrency < 1 {
+		shadowSettings.Concurrency = 1
+	}
+	shadowSlots = make(chan struct{}, shadowSettings.Concurrency)
+	slog.Info("Shadow traffic enabled", "models", shadowSettings.Models, "sample_rate", shadowSettings.SampleRate, "path", shadowSettings.Path)
+	return nil
+}
+
+// maybeShadow starts a background shadow call for a finished request if its category has a
+// shadow model and the request is sampled. Primary must hold the user-facing output and latency.
+func maybeShadow(record shadowRecord, messages []chatMessage, opts providerOptions) {
+	model, ok := sampleShadowModel(record)
+	if !ok {
+		return
+	}
+	// The shadow call outlives the request, so it only keeps the request ID for its logs
+	ctx := withRequestID(context.Background(), record.RequestID)
+	logger := logFor(ctx).With("shadow_model", model)
+	tokens, _ := countMessagesTokens(model, messages)
+	if budget := contextBudgetTokens(model); tokens > budget {
+		logger.Info("Skipping shadow call: prompt exceeds the model's budget", "tokens", tokens, "budget", budget)
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		logger.Warn("Dropping shadow call: too many calls already running", "concurrency", shadowSettings.Concurrency)
+		return
+	}
+
+	messages = append([]chatMessage(nil), messages...)
+	go func() {
+		defer func() { <-shadowSlots }()
+		start := time.Now()
+		reply, err := getOpenRouterMessage(ctx, messages, model, opts)
+		record.Shadow = shadowOutput{Model: model, Output: reply.Content, LatencyMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			record.Shadow.Error = err.Error()
+		}
+		record.Primary.estimateCost(messages)
+		record.Shadow.estimateCost(messages)
+		record.Primary.applyContentPolicy()
+		record.Shadow.applyContentPolicy()
+		if err := appendShadowRecord(record); err != nil {
+			logger.Error("Failed to store shadow result", "error", err)
+			return
+		}
+		logger.Info("Shadow call finished", "latency_ms", record.Shadow.LatencyMS,
+			"primary_model", record.Primary.Model, "primary_latency_ms", record.Primary.LatencyMS)
+	}()
+}
+
+// sampleShadowModel returns the shadow model for the record's category if the request is sampled
+// at SHADOW_SAMPLE_RATE. A category's shadow model never shadows itself.
+func sampleShadowModel(record shadowRecord) (string, bool) {
+	model, ok := shadowSettings.Models[record.Category]
+	if !ok || model == record.Primary.Model || rand.Float64() >= shadowSettings.SampleRate {
+		return "", false
+	}
+	return model, true
+}
+
+// estimateCost fills in token counts and cost for the output.
+func (o *shadowOutput) estimateCost(messages []chatMessage) {
+	o.PromptTokens, _ = countMessagesTokens(o.Model, messages)
+	o.CompletionTokens, _ = countTextTokens(o.Model, o.Output)
+	if cost, ok := estimateCostUSD(o.Model, o.PromptTokens, o.CompletionTokens); ok {
+		o.CostUSD = &cost
+	}
+}
+
+// applyContentPolicy replaces the output text according to LOG_CONTENT before it is stored.
+func (o *shadowOutput) applyContentPolicy() {
+	o.Output, o.OutputHash = storedContent(o.Output)
+}
+
+// appendShadowRecord appends a record to the shadow file.
+func appendShadowRecord(record shadowRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	shadowMu.Lock()
+	defer shadowMu.Unlock()
+	f, err := os.OpenFile(shadowSettings.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
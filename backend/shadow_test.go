@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withShadow enables shadow traffic for the given category and model, writing to a temporary file.
+func withShadow(t *testing.T, category, model string, sampleRate float64) string {
+	t.Helper()
+	previousSettings, previousSlots := shadowSettings, shadowSlots
+	t.Cleanup(func() { shadowSettings, shadowSlots = previousSettings, previousSlots })
+	path := filepath.Join(t.TempDir(), "shadow.jsonl")
+	shadowSettings = shadowConfig{Models: map[string]string{category: model}, SampleRate: sampleRate, Path: path, Concurrency: 1}
+	shadowSlots = make(chan struct{}, 1)
+	return path
+}
+
+func TestSampleShadowModel(t *testing.T) {
+	withShadow(t, "8", "openai/gpt-4.1", 0)
+	record := shadowRecord{Category: "8", Primary: shadowOutput{Model: "anthropic/claude-sonnet-4"}}
+	tests := []struct {
+		name   string
+		rate   float64
+		record shadowRecord
+		want   float64
+	}{
+		{"never", 0, record, 0},
+		{"always", 1, record, 1},
+		{"a quarter", 0.25, record, 0.25},
+		{"other category", 1, shadowRecord{Category: "1", Primary: record.Primary}, 0},
+		{"primary is the shadow model", 1, shadowRecord{Category: "8", Primary: shadowOutput{Model: "openai/gpt-4.1"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shadowSettings.SampleRate = tt.rate
+			const draws = 4000
+			sampled := 0
+			for i := 0; i < draws; i++ {
+				if _, ok := sampleShadowModel(tt.record); ok {
+					sampled++
+				}
+			}
+			if got := float64(sampled) / draws; math.Abs(got-tt.want) > 0.03 {
+				t.Errorf("sampled %.3f of requests, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShadowCallStaysOffTheResponsePath(t *testing.T) {
+	handler := setupTestRouter(t)
+	if err := loadClassificationRules(); err != nil {
+		t.Fatal(err)
+	}
+	const shadowModel = "openai/gpt-4.1"
+	path := withShadow(t, "8", shadowModel, 1)
+
+	// The shadow model doesn't answer until the user's response is complete
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req completionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		reply := "primary answer"
+		if req.Model == shadowModel {
+			<-release
+			reply = "shadow answer"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": reply}}},
+		})
+	}))
+	defer upstream.Close()
+	defer close(release) // Before upstream.Close, which waits for the blocked handler
+	previousURL := openrouterURL
+	openrouterURL = upstream.URL + "/v1/chat/completions"
+	t.Cleanup(func() { openrouterURL = previousURL })
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- postJSON(handler, "/api/chat", `{"model":"auto","messages":[{"role":"user","content":"`+"```sql\\\\nselect 1\\\\n```"+`"}]}`)
+	}()
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the response waited for the shadow call")
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "primary answer") || strings.Contains(rec.Body.String(), "shadow answer") {
+		t.Fatalf("response %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("shadow record written before the shadow model answered")
+	}
+
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), `"model":"`+shadowModel+`"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no shadow record after the shadow model answered: %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shadowSlots <- struct{}{} // Waits for the shadow goroutine to release its slot
+}
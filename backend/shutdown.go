@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Graceful shutdown ---
+//
+// On SIGINT or SIGTERM the server stops accepting connections and waits up to
+// SHUTDOWN_DRAIN_TIMEOUT for in-flight requests, including SSE streams, to finish. Streams still
+// open at the deadline are cancelled with errServerShuttingDown, which makes their handlers send
+// an error event and [DONE] before the process exits. Once the server has stopped, the spans
+// still queued are exported. A second signal exits immediately.
+
+var errServerShuttingDown = errors.New("server is shutting down")
+
+// shutdownGrace is how long cancelled streams get to write their final events.
+const shutdownGrace = 5 * time.Second
+
+// streamRegistry tracks the cancel functions of active upstream streams.
+type streamRegistry struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelCauseFunc
+}
+
+var activeStreams = &streamRegistry{cancels: make(map[int]context.CancelCauseFunc)}
+
+// track returns a context that cancelAll can cancel, and a function to call when the stream ends.
+func (s *streamRegistry) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.cancels[id] = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.cancels, id)
+		s.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelAll cancels every active stream with cause and returns how many there were.
+func (s *streamRegistry) cancelAll(cause error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancel := range s.cancels {
+		cancel(cause)
+	}
+	return len(s.cancels)
+}
+
+// flushTraces exports the spans of the drained requests, waiting at most shutdownGrace.
+func flushTraces() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := activeTracer.shutdown(ctx); err != nil {
+		slog.Warn("Failed to export the remaining spans", "error", err)
+	}
+}
+
+// serveUntilSignal runs the server until it fails or a shutdown signal arrives, then drains it.
+func serveUntilSignal(server *http.Server, serve func() error) error {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop() // Restore the default behavior, so a second signal kills the process
+	defer flushTraces()
+	return drainServer(server)
+}
+
+// drainServer stops the server, waiting up to SHUTDOWN_DRAIN_TIMEOUT for in-flight requests
+// and then ending the streams still open.
+func drainServer(server *http.Server) error {
+	drainTimeout := envDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second)
+	slog.Info("Shutting down, draining active requests", "timeout", drainTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err == nil {
+		slog.Info("Server stopped")
+		return nil
+	}
+
+	streams := activeStreams.cancelAll(errServerShuttingDown)
+	slog.Warn("Drain deadline reached, ending open streams", "streams", streams)
+	graceCtx, cancelGrace := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancelGrace()
+	if err := server.Shutdown(graceCtx); err != nil {
+		slog.Warn("Closing connections that did not finish in time", "error", err)
+		return server.Close()
+	}
+	slog.Info("Server stopped")
+	return nil
+}
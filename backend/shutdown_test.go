@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainServerEndsOpenStreams(t *testing.T) {
+	handler := setupTestRouter(t)
+	stub := newStubOpenRouter(t, "Partial reply that never finishes")
+	stub.stall = true
+	const drainTimeout = 200 * time.Millisecond
+	t.Setenv("SHUTDOWN_DRAIN_TIMEOUT", drainTimeout.String())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/api/chat",
+		strings.NewReader(`{"model":"x-ai/grok-3-mini-beta","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+	req.Header.Set(authHeaderKey, authHeaderValue)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Wait for the first chunk, so the stream is open when the drain starts
+	reader := bufio.NewReader(resp.Body)
+	var body strings.Builder
+	for !strings.Contains(body.String(), "Partial") {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the first chunk: %v\n%s", err, body.String())
+		}
+		body.WriteString(line)
+	}
+
+	started := time.Now()
+	drained := make(chan error, 1)
+	go func() { drained <- drainServer(server) }()
+	for {
+		line, err := reader.ReadString('\n')
+		body.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("drainServer() = %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed < drainTimeout {
+		t.Errorf("stream ended after %v, before the drain timeout %v", elapsed, drainTimeout)
+	}
+	rest := body.String()[strings.Index(body.String(), "Partial"):]
+	errorAt, doneAt := strings.Index(rest, "event: error"), strings.Index(rest, "data: [DONE]")
+	if errorAt < 0 || doneAt < errorAt || !strings.Contains(rest, errServerShuttingDown.Error()) {
+		t.Errorf("stream after the drain = %q, want a shutdown error event followed by [DONE]", rest)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package main
+
+// Registers the pure-Go (cgo-free) "sqlite" database/sql driver used by the conversation store.
+// It is the backend's only third-party dependency (pinned in go.mod), so it is only linked into
+// builds with -tags sqlite; other builds keep to the standard library and use the file store.
+import _ "modernc.org/sqlite"
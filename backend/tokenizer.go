@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --- Token counting ---
+//
+// Byte-level BPE tokenizers in the tiktoken format (one "<base64 token> <rank>" pair per line)
+// are loaded lazily from TOKENIZER_DIR/<encoding>.tiktoken. Models whose family has no
+// encoding, or whose vocab file is missing, fall back to the 3-chars-per-token heuristic.
+//
+// Only OpenAI and Llama 3 vocabularies are published in this format. Anthropic, Google, x-ai,
+// Mistral, Llama 4 and the other families in models.json are counted with the heuristic, so their
+// counts are estimates, reported by /api/tokenize as "method": "heuristic" and "exact": false.
+// Images are counted at a fixed estimate for every model.
+
+// Pre-tokenization patterns. Go's RE2 has no lookahead, so the `\s+(?!\S)` alternative of the
+// upstream patterns is emulated in bpeEncoding.split.
+const (
+	cl100kSplitPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`
+	o200kSplitPattern  = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+`
+)
+
+// tokenizerEncodings maps encoding names to their pre-tokenization pattern.
+var tokenizerEncodings = map[string]string{
+	"o200k_base":  o200kSplitPattern,
+	"cl100k_base": cl100kSplitPattern,
+	"llama3":      cl100kSplitPattern,
+}
+
+// tokenizerFamilies maps model ID prefixes to encodings; the longest matching prefix wins.
+// Extra mappings can be added with TOKENIZER_FAMILIES="prefix=encoding,...".
+var tokenizerFamilies = map[string]string{
+	"openai/gpt-4o":             "o200k_base",
+	"openai/gpt-4.1":            "o200k_base",
+	"openai/gpt-4.5":            "o200k_base",
+	"openai/o1":                 "o200k_base",
+	"openai/o3":                 "o200k_base",
+	"openai/o4":                 "o200k_base",
+	"openai/codex":              "o200k_base",
+	"openai/gpt-4":              "cl100k_base",
+	"openai/gpt-3.5":            "cl100k_base",
+	"meta-llama/llama-3":        "llama3",
+	"nousresearch/hermes-3-":    "llama3",
+	"nvidia/llama-3.1-nemotron": "llama3",
+}
+
+// tokenCountHeuristic is the method reported when no tokenizer is available.
+const tokenCountHeuristic = "heuristic"
+
+// bpeEncoding is a loaded byte-level BPE tokenizer.
+type bpeEncoding struct {
+	name    string
+	splitRe *regexp.Regexp
+	ranks   map[string]int
+}
+
+var (
+	tokenizerDir      = "tokenizers"
+	loadedEncodings   = make(map[string]*bpeEncoding)
+	loadedEncodingsMu sync.Mutex
+)
+
+// initTokenizers reads TOKENIZER_DIR and TOKENIZER_FAMILIES.
+func initTokenizers() error {
+	tokenizerDir = envString("TOKENIZER_DIR", tokenizerDir)
+	for _, mapping := range envList("TOKENIZER_FAMILIES", nil) {
+		prefix, encoding, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return fmt.Errorf("invalid TOKENIZER_FAMILIES entry %q, expected prefix=encoding", mapping)
+		}
+		if _, known := tokenizerEncodings[encoding]; !known {
+			return fmt.Errorf("TOKENIZER_FAMILIES: unknown encoding %q", encoding)
+		}
+		tokenizerFamilies[prefix] = encoding
+	}
+	slog.Info("Loading tokenizer vocabularies on demand", "dir", tokenizerDir)
+	return nil
+}
+
+// encodingNameForModel returns the encoding for a model, or "" if its family has none.
+func encodingNameForModel(model string) string {
+	best, bestLen := "", 0
+	for prefix, encoding := range tokenizerFamilies {
+		if strings.HasPrefix(model, prefix) && len(prefix) > bestLen {
+			best, bestLen = encoding, len(prefix)
+		}
+	}
+	return best
+}
+
+// encodingForModel returns the loaded tokenizer for a model, or nil if none is available.
+// A missing or broken vocab file is logged once and remembered.
+func encodingForModel(model string) *bpeEncoding {
+	name := encodingNameForModel(model)
+	if name == "" {
+		return nil
+	}
+	loadedEncodingsMu.Lock()
+	defer loadedEncodingsMu.Unlock()
+	if enc, ok := loadedEncodings[name]; ok {
+		return enc
+	}
+	enc, err := loadBPEEncoding(name, filepath.Join(tokenizerDir, name+".tiktoken"))
+	if err != nil {
+		slog.Warn("Tokenizer unavailable, using heuristic token counts", "tokenizer", name, "error", err)
+		enc = nil
+	} else {
+		slog.Info("Loaded tokenizer", "tokenizer", name, "tokens", len(enc.ranks))
+	}
+	loadedEncodings[name] = enc
+	return enc
+}
+
+// loadBPEEncoding parses a tiktoken vocab file.
+func loadBPEEncoding(name, path string) (*bpeEncoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int, 200000)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		tokenB64, rankStr, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: malformed line", path, lineNo)
+		}
+		token, err := base64.StdEncoding.DecodeString(tokenB64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		rank, err := strconv.Atoi(rankStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &bpeEncoding{name: name, splitRe: regexp.MustCompile(tokenizerEncodings[name]), ranks: ranks}, nil
+}
+
+// split pre-tokenizes text. A whitespace run followed by a non-space character gives up its last
+// character so the next piece can start with it, which is what `\s+(?!\S)` does upstream.
+func (e *bpeEncoding) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := e.splitRe.FindStringIndex(text)
+		if loc == nil || loc[1] == 0 {
+			pieces = append(pieces, text)
+			break
+		}
+		piece := text[loc[0]:loc[1]]
+		rest := text[loc[1]:]
+		if loc[0] > 0 {
+			// Unmatched prefix (shouldn't happen with these patterns); keep it as its own piece
+			pieces = append(pieces, text[:loc[0]])
+		}
+		if isAllSpace(piece) && !strings.ContainsAny(piece, "\r\n") && rest != "" {
+			next, _ := utf8.DecodeRuneInString(rest)
+			if !unicode.IsSpace(next) {
+				if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+					pieces = append(pieces, piece[:len(piece)-size])
+					text = text[loc[0]+len(piece)-size:]
+					continue
+				}
+			}
+		}
+		pieces = append(pieces, piece)
+		text = rest
+	}
+	return pieces
+}
+
+func isAllSpace(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Encode returns the token IDs for text.
+func (e *bpeEncoding) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range e.split(text) {
+		if rank, ok := e.ranks[piece]; ok {
+			tokens = append(tokens, rank)
+			continue
+		}
+		tokens = append(tokens, e.bytePairEncode([]byte(piece))...)
+	}
+	return tokens
+}
+
+// bytePairEncode repeatedly merges the adjacent pair with the lowest rank (the leftmost on ties),
+// as tiktoken does. Candidate merges are kept in a heap, so long pieces such as base64 blobs or
+// whitespace runs take O(n log n) rather than O(n²).
+func (e *bpeEncoding) bytePairEncode(piece []byte) []int {
+	n := len(piece)
+	if n == 0 {
+		return nil
+	}
+	// Parts form a linked list keyed by start offset; next[i] == n marks the last part.
+	next, prev := make([]int, n), make([]int, n)
+	version := make([]int, n) // Bumped when the pair starting at i changes, invalidating heap entries
+	merged := make([]bool, n)
+	for i := range piece {
+		next[i], prev[i] = i+1, i-1
+	}
+	pairRank := func(i int) (int, bool) {
+		j := next[i]
+		if j >= n {
+			return 0, false
+		}
+		rank, ok := e.ranks[string(piece[i:next[j]])]
+		return rank, ok
+	}
+
+	merges := make(bpeMergeHeap, 0, n)
+	for i := 0; i+1 < n; i++ {
+		if rank, ok := pairRank(i); ok {
+			merges = append(merges, bpeMerge{rank: rank, start: i})
+		}
+	}
+	heap.Init(&merges)
+	for merges.Len() > 0 {
+		m := heap.Pop(&merges).(bpeMerge)
+		if merged[m.start] || m.version != version[m.start] {
+			continue
+		}
+		j := next[m.start]
+		merged[j] = true
+		next[m.start] = next[j]
+		if next[j] < n {
+			prev[next[j]] = m.start
+		}
+		for _, i := range []int{m.start, prev[m.start]} {
+			if i < 0 {
+				continue
+			}
+			version[i]++
+			if rank, ok := pairRank(i); ok {
+				heap.Push(&merges, bpeMerge{rank: rank, start: i, version: version[i]})
+			}
+		}
+	}
+
+	var tokens []int
+	for i := 0; i < n; i = next[i] {
+		if rank, ok := e.ranks[string(piece[i:next[i]])]; ok {
+			tokens = append(tokens, rank)
+		} else {
+			tokens = append(tokens, -1) // Byte missing from the vocab; still counts as one token
+		}
+	}
+	return tokens
+}
+
+// bpeMerge is a candidate merge of the part starting at start with the next one.
+type bpeMerge struct {
+	rank, start, version int
+}
+
+// bpeMergeHeap orders candidate merges by rank, then position.
+type bpeMergeHeap []bpeMerge
+
+func (h bpeMergeHeap) Len() int { return len(h) }
+func (h bpeMergeHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].start < h[j].start
+}
+func (h bpeMergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bpeMergeHeap) Push(x interface{}) { *h = append(*h, x.(bpeMerge)) }
+func (h *bpeMergeHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// countTextTokens counts the tokens of text for a model and reports the method used
+// (the encoding name, or "heuristic").
+func countTextTokens(model, text string) (int, string) {
+	if enc := encodingForModel(model); enc != nil {
+		return len(enc.Encode(text)), enc.name
+	}
+	return heuristicTokenCount(text), tokenCountHeuristic
+}
+
+// heuristicTokenCount assumes an average of 3 characters per token, as ContextMaxChars does.
+func heuristicTokenCount(text string) int {
+	return (len(text) + 2) / 3
+}
+
+// messageOverheadTokens approximates the role/separator tokens added per chat message.
+const messageOverheadTokens = 4
+
+// imagePartTokens estimates an image part: OpenAI bills a 1024x1024 high-detail image at 765
+// tokens, and other providers are in the same range.
+const imagePartTokens = 765
+
+// countMessageTokens counts the prompt tokens of one chat message for a model: its text, images,
+// and the tool calls or tool call ID it carries.
+func countMessageTokens(model string, msg chatMessage) int {
+	n, _ := countTextTokens(model, msg.Content)
+	for _, partType := range msg.partTypes() {
+		if partType == "image_url" || partType == "image" {
+			n += imagePartTokens
+		}
+	}
+	if len(msg.ToolCalls) > 0 {
+		calls, _ := countTextTokens(model, string(msg.ToolCalls))
+		n += calls
+	}
+	if msg.ToolCallID != "" {
+		id, _ := countTextTokens(model, msg.ToolCallID)
+		n += id
+	}
+	return n + messageOverheadTokens
+}
+
+// countMessagesTokens counts the prompt tokens of a message list and reports the method used.
+func countMessagesTokens(model string, messages []chatMessage) (int, string) {
+	_, method := countTextTokens(model, "")
+	total := 0
+	for _, msg := range messages {
+		total += countMessageTokens(model, msg)
+	}
+	return total, method
+}
+
+// tokenizeRequest is the body of POST /api/tokenize: either text or messages.
+type tokenizeRequest struct {
+	Model        string        `json:"model"`
+	Text         string        `json:"text,omitempty"`
+	Messages     []chatMessage `json:"messages,omitempty"`
+	ReturnTokens bool          `json:"return_tokens,omitempty"` // Include token IDs for text (exact tokenizers only)
+}
+
+// tokenizeHandler counts tokens for a model without calling it.
+func tokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req tokenizeRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "Bad Request: 'model' field is required", http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{"model": req.Model}
+	if len(req.Messages) > 0 {
+		count, method := countMessagesTokens(req.Model, req.Messages)
+		resp["tokens"], resp["method"] = count, method
+	} else {
+		count, method := countTextTokens(req.Model, req.Text)
+		resp["tokens"], resp["method"] = count, method
+		if enc := encodingForModel(req.Model); req.ReturnTokens && enc != nil {
+			resp["token_ids"] = enc.Encode(req.Text)
+		}
+	}
+	resp["exact"] = resp["method"] != tokenCountHeuristic
+	jsonResponse(w, resp)
+}
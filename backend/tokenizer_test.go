@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEncoding is a tiny vocab: every byte of "abc " plus a few merges.
+func testEncoding() *bpeEncoding {
+	ranks := map[string]int{}
+	for i, token := range []string{"a", "b", "c", " ", "ab", "bc", "abc", "aa", "aaaa", "  ", "ca"} {
+		ranks[token] = i
+	}
+	return &bpeEncoding{name: "test", ranks: ranks}
+}
+
+// naiveBytePairEncode is the straightforward quadratic merge, as reference.
+func naiveBytePairEncode(ranks map[string]int, piece []byte) []int {
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		minRank, minIdx := math.MaxInt, -1
+		for i := 0; i+2 < len(parts); i++ {
+			if rank, ok := ranks[string(piece[parts[i]:parts[i+2]])]; ok && rank < minRank {
+				minRank, minIdx = rank, i
+			}
+		}
+		if minIdx < 0 {
+			break
+		}
+		parts = append(parts[:minIdx+1], parts[minIdx+2:]...)
+	}
+	var tokens []int
+	for i := 0; i+1 < len(parts); i++ {
+		if rank, ok := ranks[string(piece[parts[i]:parts[i+1]])]; ok {
+			tokens = append(tokens, rank)
+		} else {
+			tokens = append(tokens, -1)
+		}
+	}
+	return tokens
+}
+
+func TestBytePairEncode(t *testing.T) {
+	enc := testEncoding()
+	tests := []struct {
+		piece string
+		want  []int
+	}{
+		{"", nil},
+		{"a", []int{0}},
+		{"abc", []int{6}},
+		{"aaaa", []int{8}},
+		{"aaaaa", []int{8, 0}},
+		{"cab", []int{2, 4}},
+		{"xa", []int{-1, 0}},
+	}
+	for _, tt := range tests {
+		got := enc.bytePairEncode([]byte(tt.piece))
+		if !equalInts(got, tt.want) {
+			t.Errorf("bytePairEncode(%q) = %v, want %v", tt.piece, got, tt.want)
+		}
+	}
+
+	// The heap-based merge must agree with the reference on random input
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rng.Intn(40))
+		for j := range b {
+			b[j] = "abc x"[rng.Intn(5)]
+		}
+		if got, want := enc.bytePairEncode(b), naiveBytePairEncode(enc.ranks, b); !equalInts(got, want) {
+			t.Fatalf("bytePairEncode(%q) = %v, reference %v", b, got, want)
+		}
+	}
+}
+
+func TestBytePairEncodeLongPiece(t *testing.T) {
+	piece := []byte(strings.Repeat("abcab", 40000))
+	start := time.Now()
+	tokens := testEncoding().bytePairEncode(piece)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("encoding a %d-byte piece took %v", len(piece), elapsed)
+	}
+	if len(tokens) == 0 {
+		t.Fatal("no tokens")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCountMessageTokens(t *testing.T) {
+	const model = "anthropic/claude-sonnet-4" // Heuristic counts
+	text := chatMessage{Role: "user", Content: "What is in this picture?"}
+	base := countMessageTokens(model, text)
+
+	var withImage chatMessage
+	if err := json.Unmarshal([]byte(`{"role":"user","content":[{"type":"text","text":"What is in this picture?"},`+
+		`{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}`), &withImage); err != nil {
+		t.Fatal(err)
+	}
+	if got := countMessageTokens(model, withImage); got != base+imagePartTokens {
+		t.Errorf("message with an image = %d tokens, want %d", got, base+imagePartTokens)
+	}
+
+	toolCall := chatMessage{Role: "assistant", ToolCalls: json.RawMessage(`[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Zagreb\"}"}}]`)}
+	if got := countMessageTokens(model, toolCall); got <= messageOverheadTokens {
+		t.Errorf("tool call message = %d tokens, want more than the overhead", got)
+	}
+	toolResult := chatMessage{Role: "tool", ToolCallID: "call_1", Content: "18°C"}
+	if got, content := countMessageTokens(model, toolResult), heuristicTokenCount("18°C")+messageOverheadTokens; got <= content {
+		t.Errorf("tool result = %d tokens, want more than its content alone (%d)", got, content)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Tracing ---
+//
+// A small OpenTelemetry-compatible tracer: spans are created from contexts, linked to the
+// client's W3C traceparent header, propagated to Ollama and OpenRouter, and exported in
+// batches as OTLP/HTTP JSON, the last one on shutdown. Configured with the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT),
+// OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER_ARG (ratio for requests
+// without a sampled parent). Tracing is off without an endpoint, and spans are then no-ops.
+
+// Span kinds and the error status code, as numbered in OTLP.
+const (
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+// span is one timed operation. A nil *span is a valid no-op span.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attributes    map[string]interface{}
+	events        []spanEvent
+	statusCode    int
+	statusMessage string
+}
+
+type spanEvent struct {
+	name       string
+	time       time.Time
+	attributes map[string]interface{}
+}
+
+// spanContext identifies a span for propagation.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+// tracer holds the exporter configuration and the queue of finished spans.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	queue       chan *span
+	done        chan struct{} // Closed when run has exported the last batch
+
+	mu     sync.RWMutex // Guards closing queue against concurrent finish calls
+	closed bool
+}
+
+var activeTracer *tracer
+
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// initTracing starts the OTLP exporter if an endpoint is configured.
+func initTracing() error {
+	endpoint := envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint == "" {
+		if base := envString("OTEL_EXPORTER_OTLP_ENDPOINT", ""); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint:    endpoint,
+		headers:     make(map[string]string),
+		serviceName: envString("OTEL_SERVICE_NAME", "llm-router"),
+		sampleRatio: envFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+		queue:       make(chan *span, 4*traceBatchSize),
+		done:        make(chan struct{}),
+	}
+	for _, header := range envList("OTEL_EXPORTER_OTLP_HEADERS", nil) {
+		name, value, ok := strings.Cut(header, "=")
+		if !ok {
+			return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q, expected name=value", header)
+		}
+		t.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	activeTracer = t
+	go t.run()
+	slog.Info("Exporting traces", "endpoint", endpoint, "service", t.serviceName, "sample_ratio", t.sampleRatio)
+	return nil
+}
+
+// parseTraceparent parses a W3C traceparent header ("00-<trace id>-<span id>-<flags>").
+func parseTraceparent(header string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, false
+	}
+	var sc spanContext
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return spanContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return spanContext{}, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// startServerSpan starts the span for an inbound request, continuing the client's trace if the
+// request has a traceparent header.
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	if activeTracer == nil {
+		return r.Context(), nil
+	}
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !parent.sampled {
+			// Keep the client's trace ID and decision so child spans and downstream services
+			// don't start sampled traces of their own
+			return context.WithValue(r.Context(), spanContextKey{}, parent), nil
+		}
+		s := newSpan(parent.traceID, parent.spanID, name, spanKindServer)
+		return context.WithValue(r.Context(), spanContextKey{}, s), s
+	}
+	return startSpan(r.Context(), name, spanKindServer)
+}
+
+// startSpan starts a child of the context's span, or a new sampled-or-not root span. Within a
+// trace that isn't sampled it returns a nil span.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if activeTracer == nil {
+		return ctx, nil
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		s := newSpan(parent.traceID, parent.spanID, name, kind)
+		return context.WithValue(ctx, spanContextKey{}, s), s
+	}
+	if _, unsampled := ctx.Value(spanContextKey{}).(spanContext); unsampled {
+		return ctx, nil
+	}
+	var traceID [16]byte
+	rand.Read(traceID[:])
+	if mathrand.Float64() >= activeTracer.sampleRatio {
+		sc := spanContext{traceID: traceID}
+		rand.Read(sc.spanID[:])
+		return context.WithValue(ctx, spanContextKey{}, sc), nil
+	}
+	s := newSpan(traceID, [8]byte{}, name, kind)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func newSpan(traceID [16]byte, parentID [8]byte, name string, kind int) *span {
+	s := &span{traceID: traceID, parentID: parentID, name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// spanFromContext returns the current span, or nil if there is none or the trace isn't sampled.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// traceFromContext returns the identity of the context's trace, sampled or not. The context
+// holds either a recording *span or, for a trace that isn't sampled, just its spanContext.
+func traceFromContext(ctx context.Context) (spanContext, bool) {
+	switch v := ctx.Value(spanContextKey{}).(type) {
+	case *span:
+		return spanContext{traceID: v.traceID, spanID: v.spanID, sampled: true}, true
+	case spanContext:
+		return v, true
+	}
+	return spanContext{}, false
+}
+
+// injectTraceparent propagates the context's trace and sampling decision to an outbound request.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	sc, ok := traceFromContext(ctx)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	req.Header.Set("traceparent", fmt.Sprintf("00-%x-%x-%s", sc.traceID, sc.spanID, flags))
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) addEvent(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, spanEvent{name: name, time: time.Now(), attributes: attributes})
+	s.mu.Unlock()
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode, s.statusMessage = spanStatusError, err.Error()
+	s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export, dropping it if the queue is full.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	t := activeTracer
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		slog.Warn("Trace export queue full, dropping span", "span", s.name)
+	}
+}
+
+// run batches finished spans and exports them until the queue is closed.
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				if len(batch) > 0 {
+					if err := t.export(batch); err != nil {
+						slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+					}
+				}
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// shutdown stops accepting spans, exports those still queued and waits for the export to finish
+// or ctx to end. Spans finished afterwards are dropped.
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// export sends spans to the collector as an OTLP/HTTP JSON request.
+func (t *tracer) export(spans []*span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.toOTLP())
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.serviceName, "host.name": hostname()}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "llm-router"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(mustJSON(payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *span) toOTLP() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if len(s.events) > 0 {
+		events := make([]map[string]interface{}, 0, len(s.events))
+		for _, e := range s.events {
+			events = append(events, map[string]interface{}{
+				"name":         e.name,
+				"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10),
+				"attributes":   otlpAttributes(e.attributes),
+			})
+		}
+		out["events"] = events
+	}
+	if s.statusCode != 0 {
+		out["status"] = map[string]interface{}{"code": s.statusCode, "message": s.statusMessage}
+	}
+	return out
+}
+
+// otlpAttributes converts attributes to OTLP's typed key/value list.
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attributes))
+	for _, key := range sortedKeys(attributes) {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": string(mustJSON(v))}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": value})
+	}
+	return list
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
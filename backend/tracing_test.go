@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withTracer(t *testing.T, sampleRatio float64) {
+	t.Helper()
+	previous := activeTracer
+	activeTracer = &tracer{sampleRatio: sampleRatio, queue: make(chan *span, 16), done: make(chan struct{})}
+	t.Cleanup(func() { activeTracer = previous })
+}
+
+func TestTracePropagation(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceparent string
+		sampleRatio float64
+		wantSpans   bool
+		wantTraceID string // Expected trace ID downstream, "" for any
+		wantFlags   string
+	}{
+		{"sampled parent", "00-" + traceID + "-00f067aa0ba902b7-01", 0, true, traceID, "01"},
+		{"unsampled parent", "00-" + traceID + "-00f067aa0ba902b7-00", 1, false, traceID, "00"},
+		{"new trace sampled", "", 1, true, "", "01"},
+		{"new trace not sampled", "", 0, false, "", "00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTracer(t, tt.sampleRatio)
+			req := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			ctx, server := startServerSpan(req, "POST /api/chat")
+			ctx, child := startSpan(ctx, "openrouter", spanKindClient)
+			if (server != nil) != tt.wantSpans || (child != nil) != tt.wantSpans {
+				t.Fatalf("server span %v, child span %v, want recording %v", server != nil, child != nil, tt.wantSpans)
+			}
+			if tt.wantSpans && child.traceID != server.traceID {
+				t.Errorf("child span started a new trace")
+			}
+
+			out, _ := http.NewRequest(http.MethodPost, "http://upstream", nil)
+			injectTraceparent(ctx, out)
+			parent, ok := parseTraceparent(out.Header.Get("traceparent"))
+			if !ok {
+				t.Fatalf("traceparent = %q, want a valid header", out.Header.Get("traceparent"))
+			}
+			if tt.wantTraceID != "" && !strings.Contains(out.Header.Get("traceparent"), tt.wantTraceID) {
+				t.Errorf("traceparent = %q, want trace %s", out.Header.Get("traceparent"), tt.wantTraceID)
+			}
+			if got := out.Header.Get("traceparent")[53:]; got != tt.wantFlags {
+				t.Errorf("flags = %s, want %s", got, tt.wantFlags)
+			}
+			if parent.sampled != tt.wantSpans {
+				t.Errorf("sampled = %v, want %v", parent.sampled, tt.wantSpans)
+			}
+		})
+	}
+}
+
+func TestTracerShutdownExportsQueuedSpans(t *testing.T) {
+	var mu sync.Mutex
+	exported := 0
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []json.RawMessage `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		for _, rs := range payload.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				exported += len(ss.Spans)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	previous := activeTracer
+	t.Cleanup(func() { activeTracer = previous })
+	activeTracer = &tracer{endpoint: collector.URL, sampleRatio: 1, queue: make(chan *span, 16), done: make(chan struct{})}
+	go activeTracer.run()
+	for i := 0; i < 3; i++ {
+		_, s := startSpan(context.Background(), "work", spanKindServer)
+		s.finish()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := activeTracer.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if exported != 3 {
+		t.Errorf("exported %d spans, want 3", exported)
+	}
+
+	// Spans finishing after shutdown are dropped rather than sent on the closed queue
+	_, late := startSpan(context.Background(), "late", spanKindServer)
+	late.finish()
+}